@@ -42,6 +42,16 @@ func Run(configFile string) (out Stoppable, err error) {
 		out, err = listener.StartListener(c)
 	case "listener_http":
 		out, err = listener.StartHTTPListener(c)
+	case "listener_tcp":
+		out, err = listener.StartTCPListener(c)
+	case "listener_unix":
+		out, err = listener.StartUnixListener(c)
+	case "listener_graphite":
+		out, err = listener.StartGraphiteListener(c)
+	case "listener_statsd":
+		out, err = listener.StartStatsdListener(c)
+	case "listener_opentsdb":
+		out, err = listener.StartOpenTSDBListener(c)
 	case "filter":
 		out, err = filter.StartFilter(c)
 	case "writer":
@@ -31,52 +31,115 @@ const commonFileName = "/etc/influx-spout.toml"
 // Config represents the configuration for a single influx-spout
 // component.
 type Config struct {
-	Name                string   `toml:"name"`
-	Mode                string   `toml:"mode"`
-	NATSAddress         string   `toml:"nats_address"`
-	NATSSubject         []string `toml:"nats_subject"`
-	NATSSubjectMonitor  string   `toml:"nats_subject_monitor"`
-	NATSSubjectJunkyard string   `toml:"nats_subject_junkyard"`
-	InfluxDBAddress     string   `toml:"influxdb_address"`
-	InfluxDBPort        int      `toml:"influxdb_port"`
-	DBName              string   `toml:"influxdb_dbname"`
-	BatchMessages       int      `toml:"batch"`
-	BatchMaxMB          int      `toml:"batch_max_mb"`
-	BatchMaxSecs        int      `toml:"batch_max_secs"`
-	Port                int      `toml:"port"`
-	Workers             int      `toml:"workers"`
-	WriteTimeoutSecs    int      `toml:"write_timeout_secs"`
-	ReadBufferBytes     int      `toml:"read_buffer_bytes"`
-	NATSPendingMaxMB    int      `toml:"nats_pending_max_mb"`
-	ListenerBatchBytes  int      `toml:"listener_batch_bytes"`
-	Rule                []Rule   `toml:"rule"`
-	Debug               bool     `toml:"debug"`
+	Name                      string            `toml:"name"`
+	Mode                      string            `toml:"mode"`
+	NATSAddress               string            `toml:"nats_address"`
+	NATSSubject               []string          `toml:"nats_subject"`
+	NATSSubjectMonitor        string            `toml:"nats_subject_monitor"`
+	NATSSubjectJunkyard       string            `toml:"nats_subject_junkyard"`
+	NATSSubjectInvalid        string            `toml:"nats_subject_invalid"`
+	InfluxDBAddress           string            `toml:"influxdb_address"`
+	InfluxDBPort              int               `toml:"influxdb_port"`
+	DBName                    string            `toml:"influxdb_dbname"`
+	BatchMessages             int               `toml:"batch"`
+	BatchMaxMB                int               `toml:"batch_max_mb"`
+	BatchMaxSecs              int               `toml:"batch_max_secs"`
+	Port                      int               `toml:"port"`
+	Workers                   int               `toml:"workers"`
+	WriteTimeoutSecs          int               `toml:"write_timeout_secs"`
+	ReadBufferBytes           int               `toml:"read_buffer_bytes"`
+	NATSPendingMaxMB          int               `toml:"nats_pending_max_mb"`
+	ListenerBatchBytes        int               `toml:"listener_batch_bytes"`
+	ListenerBatchMaxMS        int               `toml:"listener_batch_max_ms"`
+	ListenerMaxConnections    int               `toml:"listener_max_connections"`
+	ListenerIdleTimeoutSecs   int               `toml:"listener_idle_timeout_secs"`
+	ListenerMaxBodyMB         int               `toml:"listener_max_body_mb"`
+	ListenerNATSBufferMB      int               `toml:"listener_nats_buffer_mb"`
+	ListenerDefaultPrecision  string            `toml:"listener_default_precision"`
+	ListenerDBSubjects        map[string]string `toml:"listener_db_subjects"`
+	ListenerDBSubjectTemplate string            `toml:"listener_db_subject_template"`
+	ListenerDBSubjectsMax     int               `toml:"listener_db_subjects_max"`
+	ListenerAuthUsers         map[string]string `toml:"listener_auth_users"`
+	ListenerAuthFile          string            `toml:"listener_auth_file"`
+	TLSCertFile               string            `toml:"tls_cert_file"`
+	TLSKeyFile                string            `toml:"tls_key_file"`
+	TLSClientCAFile           string            `toml:"tls_client_ca_file"`
+	ListenerSocketPath        string            `toml:"listener_socket_path"`
+	ListenerSocketType        string            `toml:"listener_socket_type"`
+	ListenerSocketMode        string            `toml:"listener_socket_mode"`
+	ListenerSocketOwner       string            `toml:"listener_socket_owner"`
+	ListenerSocketGroup       string            `toml:"listener_socket_group"`
+	ListenerUDPSockets        int               `toml:"listener_udp_sockets"`
+	ListenerValidate          bool              `toml:"listener_validate"`
+	ListenerRateLimits        []RateLimit       `toml:"listener_rate_limit"`
+	GraphiteTemplates         []string          `toml:"graphite_templates"`
+	GraphiteSeparator         string            `toml:"graphite_separator"`
+	StatsdFlushIntervalMS     int               `toml:"statsd_flush_interval_ms"`
+	StatsdPercentiles         []float64         `toml:"statsd_percentiles"`
+	StatsdGaugeExpiryMS       int               `toml:"statsd_gauge_expiry_ms"`
+	Rule                      []Rule            `toml:"rule"`
+	Debug                     bool              `toml:"debug"`
 }
 
 // Rule contains the configuration for a single filter rule.
 type Rule struct {
-	Rtype   string `toml:"type"`
-	Match   string `toml:"match"`
-	Subject string `toml:"subject"`
+	Rtype     string `toml:"type"`
+	Match     string `toml:"match"`
+	Subject   string `toml:"subject"`
+	Tag       string `toml:"tag"`        // tag rules only
+	MatchType string `toml:"match_type"` // tag rules only
+
+	// Continue allows lines matching the rule to also be checked
+	// against (and sent to the subjects of) the following rules.
+	Continue bool `toml:"continue"`
+
+	// Rules which combine other rules set one of these instead of
+	// Rtype. The subjects of the combined rules aren't used.
+	All []Rule `toml:"all"`
+	Any []Rule `toml:"any"`
+	Not *Rule  `toml:"not"`
+}
+
+// RateLimit contains the configuration for a listener rate limit.
+// The limit applies separately to each source address within CIDR or
+// to the authenticated HTTP user User.
+type RateLimit struct {
+	CIDR        string `toml:"cidr"`
+	User        string `toml:"user"`
+	LinesPerSec int    `toml:"lines_per_sec"`
+	Burst       int    `toml:"burst"`
 }
 
 func newDefaultConfig() *Config {
 	return &Config{
-		NATSAddress:         "nats://localhost:4222",
-		NATSSubject:         []string{"influx-spout"},
-		NATSSubjectMonitor:  "influx-spout-monitor",
-		NATSSubjectJunkyard: "influx-spout-junk",
-		InfluxDBAddress:     "localhost",
-		InfluxDBPort:        8086,
-		DBName:              "influx-spout-junk",
-		BatchMessages:       10,
-		BatchMaxMB:          10,
-		BatchMaxSecs:        300,
-		Workers:             8,
-		WriteTimeoutSecs:    30,
-		ReadBufferBytes:     4 * 1024 * 1024,
-		NATSPendingMaxMB:    200,
-		ListenerBatchBytes:  1024 * 1024,
+		NATSAddress:             "nats://localhost:4222",
+		NATSSubject:             []string{"influx-spout"},
+		NATSSubjectMonitor:      "influx-spout-monitor",
+		NATSSubjectJunkyard:     "influx-spout-junk",
+		NATSSubjectInvalid:      "influx-spout-invalid",
+		InfluxDBAddress:         "localhost",
+		InfluxDBPort:            8086,
+		DBName:                  "influx-spout-junk",
+		BatchMessages:           10,
+		BatchMaxMB:              10,
+		BatchMaxSecs:            300,
+		Workers:                 8,
+		WriteTimeoutSecs:        30,
+		ReadBufferBytes:         4 * 1024 * 1024,
+		NATSPendingMaxMB:        200,
+		ListenerBatchBytes:      1024 * 1024,
+		ListenerBatchMaxMS:      1000,
+		ListenerMaxConnections:  1024,
+		ListenerIdleTimeoutSecs: 300,
+		ListenerMaxBodyMB:       100,
+		ListenerNATSBufferMB:    8,
+		ListenerDBSubjectsMax:   100,
+		ListenerSocketType:      "stream",
+		ListenerUDPSockets:      1,
+		GraphiteSeparator:       ".",
+		StatsdFlushIntervalMS:   10000,
+		StatsdPercentiles:       []float64{90},
+		StatsdGaugeExpiryMS:     3600000,
 	}
 }
 
@@ -99,10 +162,16 @@ func NewConfigFromFile(fileName string) (*Config, error) {
 	if conf.Name == "" {
 		conf.Name = pathToConfigName(fileName)
 	}
-	if conf.Mode == "listener" && conf.Port == 0 {
+	if (conf.Mode == "listener" || conf.Mode == "listener_tcp") && conf.Port == 0 {
 		conf.Port = 10001
 	} else if conf.Mode == "listener_http" && conf.Port == 0 {
 		conf.Port = 13337
+	} else if conf.Mode == "listener_graphite" && conf.Port == 0 {
+		conf.Port = 2003
+	} else if conf.Mode == "listener_statsd" && conf.Port == 0 {
+		conf.Port = 8125
+	} else if conf.Mode == "listener_opentsdb" && conf.Port == 0 {
+		conf.Port = 4242
 	}
 	return conf, nil
 }
@@ -54,6 +54,47 @@ write_timeout_secs = 32
 read_buffer_bytes = 43210
 nats_pending_max_mb = 100
 listener_batch_bytes = 4096
+listener_batch_max_ms = 250
+listener_max_connections = 50
+listener_idle_timeout_secs = 120
+listener_max_body_mb = 20
+listener_nats_buffer_mb = 16
+listener_db_subjects_max = 20
+listener_default_precision = "ms"
+listener_db_subject_template = "spout.db.{db}"
+listener_auth_file = "/etc/influx-spout/creds"
+tls_cert_file = "/etc/influx-spout/cert.pem"
+tls_key_file = "/etc/influx-spout/key.pem"
+tls_client_ca_file = "/etc/influx-spout/ca.pem"
+listener_socket_path = "/var/run/spout.sock"
+listener_socket_type = "datagram"
+listener_socket_mode = "0660"
+listener_socket_owner = "spout"
+listener_socket_group = "metrics"
+listener_udp_sockets = 4
+listener_validate = true
+nats_subject_invalid = "spout-invalid"
+graphite_templates = ["servers.* .host.measurement*", "measurement.field*"]
+graphite_separator = "_"
+statsd_flush_interval_ms = 5000
+statsd_percentiles = [50.0, 99.9]
+statsd_gauge_expiry_ms = 60000
+
+[listener_db_subjects]
+foo = "spout-foo"
+bar = "spout-bar"
+
+[listener_auth_users]
+alice = "secret"
+
+[[listener_rate_limit]]
+cidr = "10.0.0.0/8"
+lines_per_sec = 1000
+burst = 5000
+
+[[listener_rate_limit]]
+user = "alice"
+lines_per_sec = 50
 `
 	conf, err := parseConfig(validConfigSample)
 	require.NoError(t, err, "Couldn't parse a valid config: %v\n", err)
@@ -69,6 +110,37 @@ listener_batch_bytes = 4096
 	assert.Equal(t, 43210, conf.ReadBufferBytes)
 	assert.Equal(t, 100, conf.NATSPendingMaxMB, "NATSPendingMaxMB must match")
 	assert.Equal(t, 4096, conf.ListenerBatchBytes, "NATSPendingMaxMB must match")
+	assert.Equal(t, 250, conf.ListenerBatchMaxMS)
+	assert.Equal(t, 50, conf.ListenerMaxConnections)
+	assert.Equal(t, 120, conf.ListenerIdleTimeoutSecs)
+	assert.Equal(t, 20, conf.ListenerMaxBodyMB)
+	assert.Equal(t, 16, conf.ListenerNATSBufferMB)
+	assert.Equal(t, 20, conf.ListenerDBSubjectsMax)
+	assert.Equal(t, "ms", conf.ListenerDefaultPrecision)
+	assert.Equal(t, map[string]string{"foo": "spout-foo", "bar": "spout-bar"}, conf.ListenerDBSubjects)
+	assert.Equal(t, "spout.db.{db}", conf.ListenerDBSubjectTemplate)
+	assert.Equal(t, map[string]string{"alice": "secret"}, conf.ListenerAuthUsers)
+	assert.Equal(t, "/etc/influx-spout/creds", conf.ListenerAuthFile)
+	assert.Equal(t, "/etc/influx-spout/cert.pem", conf.TLSCertFile)
+	assert.Equal(t, "/etc/influx-spout/key.pem", conf.TLSKeyFile)
+	assert.Equal(t, "/etc/influx-spout/ca.pem", conf.TLSClientCAFile)
+	assert.Equal(t, "/var/run/spout.sock", conf.ListenerSocketPath)
+	assert.Equal(t, "datagram", conf.ListenerSocketType)
+	assert.Equal(t, "0660", conf.ListenerSocketMode)
+	assert.Equal(t, "spout", conf.ListenerSocketOwner)
+	assert.Equal(t, "metrics", conf.ListenerSocketGroup)
+	assert.Equal(t, 4, conf.ListenerUDPSockets)
+	assert.Equal(t, true, conf.ListenerValidate)
+	assert.Equal(t, "spout-invalid", conf.NATSSubjectInvalid)
+	assert.Equal(t, []RateLimit{
+		{CIDR: "10.0.0.0/8", LinesPerSec: 1000, Burst: 5000},
+		{User: "alice", LinesPerSec: 50},
+	}, conf.ListenerRateLimits)
+	assert.Equal(t, []string{"servers.* .host.measurement*", "measurement.field*"}, conf.GraphiteTemplates)
+	assert.Equal(t, "_", conf.GraphiteSeparator)
+	assert.Equal(t, 5000, conf.StatsdFlushIntervalMS)
+	assert.Equal(t, []float64{50, 99.9}, conf.StatsdPercentiles)
+	assert.Equal(t, 60000, conf.StatsdGaugeExpiryMS)
 
 	assert.Equal(t, 8086, conf.InfluxDBPort, "InfluxDB Port must match")
 	assert.Equal(t, "junk_nats", conf.DBName, "InfluxDB DBname must match")
@@ -101,6 +173,34 @@ func TestAllDefaults(t *testing.T) {
 	assert.Equal(t, 4194304, conf.ReadBufferBytes)
 	assert.Equal(t, 200, conf.NATSPendingMaxMB)
 	assert.Equal(t, 1048576, conf.ListenerBatchBytes)
+	assert.Equal(t, 1000, conf.ListenerBatchMaxMS)
+	assert.Equal(t, 1024, conf.ListenerMaxConnections)
+	assert.Equal(t, 300, conf.ListenerIdleTimeoutSecs)
+	assert.Equal(t, 100, conf.ListenerMaxBodyMB)
+	assert.Equal(t, 8, conf.ListenerNATSBufferMB)
+	assert.Equal(t, 100, conf.ListenerDBSubjectsMax)
+	assert.Equal(t, "", conf.ListenerDefaultPrecision)
+	assert.Len(t, conf.ListenerDBSubjects, 0)
+	assert.Equal(t, "", conf.ListenerDBSubjectTemplate)
+	assert.Len(t, conf.ListenerAuthUsers, 0)
+	assert.Equal(t, "", conf.ListenerAuthFile)
+	assert.Equal(t, "", conf.TLSCertFile)
+	assert.Equal(t, "", conf.TLSKeyFile)
+	assert.Equal(t, "", conf.TLSClientCAFile)
+	assert.Equal(t, "", conf.ListenerSocketPath)
+	assert.Equal(t, "stream", conf.ListenerSocketType)
+	assert.Equal(t, "", conf.ListenerSocketMode)
+	assert.Equal(t, "", conf.ListenerSocketOwner)
+	assert.Equal(t, "", conf.ListenerSocketGroup)
+	assert.Equal(t, 1, conf.ListenerUDPSockets)
+	assert.Equal(t, false, conf.ListenerValidate)
+	assert.Equal(t, "influx-spout-invalid", conf.NATSSubjectInvalid)
+	assert.Len(t, conf.ListenerRateLimits, 0)
+	assert.Len(t, conf.GraphiteTemplates, 0)
+	assert.Equal(t, ".", conf.GraphiteSeparator)
+	assert.Equal(t, 10000, conf.StatsdFlushIntervalMS)
+	assert.Equal(t, []float64{90}, conf.StatsdPercentiles)
+	assert.Equal(t, 3600000, conf.StatsdGaugeExpiryMS)
 	assert.Equal(t, false, conf.Debug)
 	assert.Len(t, conf.Rule, 0)
 }
@@ -117,6 +217,30 @@ func TestDefaultPortHTTPListener(t *testing.T) {
 	assert.Equal(t, 13337, conf.Port)
 }
 
+func TestDefaultPortTCPListener(t *testing.T) {
+	conf, err := parseConfig(`mode = "listener_tcp"`)
+	require.NoError(t, err)
+	assert.Equal(t, 10001, conf.Port)
+}
+
+func TestDefaultPortGraphiteListener(t *testing.T) {
+	conf, err := parseConfig(`mode = "listener_graphite"`)
+	require.NoError(t, err)
+	assert.Equal(t, 2003, conf.Port)
+}
+
+func TestDefaultPortStatsdListener(t *testing.T) {
+	conf, err := parseConfig(`mode = "listener_statsd"`)
+	require.NoError(t, err)
+	assert.Equal(t, 8125, conf.Port)
+}
+
+func TestDefaultPortOpenTSDBListener(t *testing.T) {
+	conf, err := parseConfig(`mode = "listener_opentsdb"`)
+	require.NoError(t, err)
+	assert.Equal(t, 4242, conf.Port)
+}
+
 func TestNoMode(t *testing.T) {
 	_, err := parseConfig("")
 	assert.EqualError(t, err, "mode not specified in config")
@@ -148,26 +272,90 @@ workers = 96
 type = "basic"
 match = "hello"
 subject = "hello-subject"
+continue = true
 
 [[rule]]
 type = "basic"
 match = "world"
 subject = "world-subject"
+
+[[rule]]
+type = "tag"
+tag = "host"
+match = "web*"
+match_type = "glob"
+subject = "web-subject"
 `
 	conf, err := parseConfig(rulesConfig)
 	require.NoError(t, err, "config should be parsed")
 
-	assert.Len(t, conf.Rule, 2)
+	assert.Len(t, conf.Rule, 3)
 	assert.Equal(t, conf.Rule[0], Rule{
-		Rtype:   "basic",
-		Match:   "hello",
-		Subject: "hello-subject",
+		Rtype:    "basic",
+		Match:    "hello",
+		Subject:  "hello-subject",
+		Continue: true,
 	})
 	assert.Equal(t, conf.Rule[1], Rule{
 		Rtype:   "basic",
 		Match:   "world",
 		Subject: "world-subject",
 	})
+	assert.Equal(t, conf.Rule[2], Rule{
+		Rtype:     "tag",
+		Tag:       "host",
+		Match:     "web*",
+		MatchType: "glob",
+		Subject:   "web-subject",
+	})
+}
+
+func TestComposedRulesConfig(t *testing.T) {
+	const rulesConfig = `
+mode = "filter"
+
+[[rule]]
+subject = "cpu-ny4"
+
+  [[rule.all]]
+  type = "basic"
+  match = "cpu"
+
+  [[rule.all]]
+  type = "tag"
+  tag = "dc"
+  match = "ny4"
+
+  [[rule.all]]
+  not = { type = "tag", tag = "host", match = "^test", match_type = "regex" }
+
+[[rule]]
+subject = "mem-or-disk"
+any = [
+  { type = "basic", match = "mem" },
+  { type = "basic", match = "disk" },
+]
+`
+	conf, err := parseConfig(rulesConfig)
+	require.NoError(t, err, "config should be parsed")
+
+	assert.Equal(t, []Rule{
+		{
+			Subject: "cpu-ny4",
+			All: []Rule{
+				{Rtype: "basic", Match: "cpu"},
+				{Rtype: "tag", Tag: "dc", Match: "ny4"},
+				{Not: &Rule{Rtype: "tag", Tag: "host", Match: "^test", MatchType: "regex"}},
+			},
+		},
+		{
+			Subject: "mem-or-disk",
+			Any: []Rule{
+				{Rtype: "basic", Match: "mem"},
+				{Rtype: "basic", Match: "disk"},
+			},
+		},
+	}, conf.Rule)
 }
 
 func TestCommonOverlay(t *testing.T) {
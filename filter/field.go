@@ -0,0 +1,244 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type fieldType int
+
+const (
+	fieldNumber fieldType = iota
+	fieldString
+	fieldBool
+)
+
+// fieldExpr is a parsed field rule expression (see CreateFieldRule).
+type fieldExpr struct {
+	key []byte
+
+	// op is "" if the expression only checks that the field exists.
+	op string
+
+	// The value to compare the field's value to. Only the members for
+	// typ are used.
+	typ   fieldType
+	num   numValue
+	str   []byte
+	boolV bool
+}
+
+// numValue is a numeric field value. Integers are kept as integers so
+// that they can be compared exactly.
+type numValue struct {
+	isInt bool
+	i     int64
+	f     float64
+}
+
+// parseFieldExpr parses a field rule expression of the form
+// "<field> [<op> <value>]".
+func parseFieldExpr(expr string) (*fieldExpr, error) {
+	opStart := strings.IndexAny(expr, "=!<>")
+	if opStart == -1 {
+		key := strings.TrimSpace(expr)
+		if key == "" {
+			return nil, errors.New("missing field name")
+		}
+		return &fieldExpr{key: []byte(key)}, nil
+	}
+
+	key := strings.TrimSpace(expr[:opStart])
+	if key == "" {
+		return nil, errors.New("missing field name")
+	}
+	op := expr[opStart : opStart+1]
+	if opStart+1 < len(expr) && expr[opStart+1] == '=' {
+		op = expr[opStart : opStart+2]
+	}
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("invalid operator %q", op)
+	}
+
+	fe := &fieldExpr{key: []byte(key), op: op}
+	literal := strings.TrimSpace(expr[opStart+len(op):])
+	switch {
+	case literal == "":
+		return nil, errors.New("missing value")
+	case literal[0] == '"':
+		s, err := strconv.Unquote(literal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", literal)
+		}
+		fe.typ = fieldString
+		fe.str = []byte(s)
+	case literal == "true" || literal == "false":
+		fe.typ = fieldBool
+		fe.boolV = literal == "true"
+	default:
+		num, ok := parseNumber([]byte(strings.TrimSuffix(literal, "i")))
+		if !ok {
+			return nil, fmt.Errorf("invalid value %q", literal)
+		}
+		fe.typ = fieldNumber
+		fe.num = num
+	}
+
+	if fe.typ != fieldNumber && op != "==" && op != "!=" {
+		return nil, fmt.Errorf("operator %s can only be used with numbers", op)
+	}
+	return fe, nil
+}
+
+// match reports whether the raw field value (as returned by
+// fieldValue) satisfies the expression. Values of a different type to
+// the expression's value never match.
+func (fe *fieldExpr) match(raw []byte) bool {
+	if fe.op == "" {
+		return true
+	}
+	if len(raw) == 0 {
+		return false
+	}
+
+	switch fe.typ {
+	case fieldString:
+		if raw[0] != '"' || len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return false
+		}
+		equal := bytes.Equal(unescapeFieldString(raw[1:len(raw)-1]), fe.str)
+		return equal == (fe.op == "==")
+	case fieldBool:
+		b, ok := parseBool(raw)
+		if !ok {
+			return false
+		}
+		return (b == fe.boolV) == (fe.op == "==")
+	}
+
+	num, ok := parseFieldNumber(raw)
+	if !ok {
+		return false
+	}
+	c := compareNumbers(num, fe.num)
+	switch fe.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default: // ">="
+		return c >= 0
+	}
+}
+
+// parseFieldNumber parses a numeric field value: an integer with an
+// "i" (or unsigned integer with a "u") suffix, or a float.
+func parseFieldNumber(raw []byte) (numValue, bool) {
+	switch raw[len(raw)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(string(raw[:len(raw)-1]), 10, 64)
+		return numValue{isInt: true, i: i}, err == nil
+	case 'u':
+		u, err := strconv.ParseUint(string(raw[:len(raw)-1]), 10, 64)
+		if err != nil {
+			return numValue{}, false
+		}
+		if u > 1<<63-1 {
+			return numValue{f: float64(u)}, true
+		}
+		return numValue{isInt: true, i: int64(u)}, true
+	}
+	f, err := strconv.ParseFloat(string(raw), 64)
+	return numValue{f: f}, err == nil
+}
+
+// parseNumber parses a number in a field rule expression. Whole
+// numbers are kept as integers.
+func parseNumber(s []byte) (numValue, bool) {
+	if i, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		return numValue{isInt: true, i: i, f: float64(i)}, true
+	}
+	f, err := strconv.ParseFloat(string(s), 64)
+	return numValue{f: f}, err == nil
+}
+
+// compareNumbers returns -1, 0 or 1 if a is less than, equal to or
+// greater than b.
+func compareNumbers(a, b numValue) int {
+	if a.isInt && b.isInt {
+		switch {
+		case a.i < b.i:
+			return -1
+		case a.i > b.i:
+			return 1
+		}
+		return 0
+	}
+
+	af, bf := a.f, b.f
+	if a.isInt {
+		af = float64(a.i)
+	}
+	if b.isInt {
+		bf = float64(b.i)
+	}
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// parseBool parses a boolean field value.
+func parseBool(raw []byte) (bool, bool) {
+	switch string(raw) {
+	case "t", "T", "true", "True", "TRUE":
+		return true, true
+	case "f", "F", "false", "False", "FALSE":
+		return false, true
+	}
+	return false, false
+}
+
+// unescapeFieldString returns the unescaped version of a string field
+// value (without its quotes).
+func unescapeFieldString(in []byte) []byte {
+	if bytes.IndexByte(in, '\\') == -1 {
+		return in
+	}
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == '\\' && i+1 < len(in) && (in[i+1] == '"' || in[i+1] == '\\') {
+			i++
+		}
+		out = append(out, in[i])
+	}
+	return out
+}
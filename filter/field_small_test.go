@@ -0,0 +1,162 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldValue(t *testing.T) {
+	check := func(line, key, expected string, expectedOK bool) {
+		value, ok := fieldValue([]byte(line), []byte(key))
+		assert.Equal(t, expectedOK, ok, "fieldValue(%q, %q)", line, key)
+		assert.Equal(t, expected, string(value), "fieldValue(%q, %q)", line, key)
+	}
+
+	check("cpu x=1", "x", "1", true)
+	check("cpu x=1 1500000000", "x", "1", true)
+	check("cpu x=1\n", "x", "1", true)
+	check("cpu,host=a x=1i,y=2.5,z=t", "x", "1i", true)
+	check("cpu,host=a x=1i,y=2.5,z=t", "y", "2.5", true)
+	check("cpu,host=a x=1i,y=2.5,z=t 1500000000", "z", "t", true)
+	check(`cpu s="a b,c=d",x=1`, "s", `"a b,c=d"`, true)
+	check(`cpu s="a \"b\", c",x=1`, "x", "1", true)
+	check(`cpu s="a\\",x=1`, "x", "1", true)
+	check(`cpu,host\ name=x\ y my\ f\=ield=1`, "my f=ield", "1", true)
+
+	check("cpu,x=1 y=1", "x", "", false)
+	check("x=1 y=1", "x", "", false)
+	check(`cpu s="x=1"`, "x", "", false)
+	check("cpu x=1 y=2", "y", "", false)
+	check("cpu x=1", "y", "", false)
+	check("cpu\nx=1", "x", "", false)
+	check("cpu", "cpu", "", false)
+	check("cpu x", "x", "", false)
+	check("", "x", "", false)
+}
+
+func TestParseFieldExpr(t *testing.T) {
+	fe, err := parseFieldExpr(" value ")
+	require.NoError(t, err)
+	assert.Equal(t, &fieldExpr{key: []byte("value")}, fe)
+
+	fe, err = parseFieldExpr("value>1e9")
+	require.NoError(t, err)
+	assert.Equal(t, &fieldExpr{
+		key: []byte("value"),
+		op:  ">",
+		typ: fieldNumber,
+		num: numValue{f: 1e9},
+	}, fe)
+
+	fe, err = parseFieldExpr("count <= 10i")
+	require.NoError(t, err)
+	assert.Equal(t, &fieldExpr{
+		key: []byte("count"),
+		op:  "<=",
+		typ: fieldNumber,
+		num: numValue{isInt: true, i: 10, f: 10},
+	}, fe)
+
+	fe, err = parseFieldExpr(`status == "an \"error\""`)
+	require.NoError(t, err)
+	assert.Equal(t, &fieldExpr{
+		key: []byte("status"),
+		op:  "==",
+		typ: fieldString,
+		str: []byte(`an "error"`),
+	}, fe)
+
+	fe, err = parseFieldExpr("up != false")
+	require.NoError(t, err)
+	assert.Equal(t, &fieldExpr{
+		key: []byte("up"),
+		op:  "!=",
+		typ: fieldBool,
+	}, fe)
+}
+
+func TestParseFieldExprErrors(t *testing.T) {
+	check := func(expr, expected string) {
+		_, err := parseFieldExpr(expr)
+		assert.EqualError(t, err, expected, "parseFieldExpr(%q)", expr)
+	}
+
+	check("", "missing field name")
+	check("  ", "missing field name")
+	check("> 1", "missing field name")
+	check("x = 1", `invalid operator "="`)
+	check("x ! 1", `invalid operator "!"`)
+	check("x =< 1", `invalid operator "="`)
+	check("x >", "missing value")
+	check("x > one", `invalid value "one"`)
+	check(`x == "a`, `invalid string "a`)
+	check(`x > "a"`, "operator > can only be used with numbers")
+	check("x <= true", "operator <= can only be used with numbers")
+}
+
+func TestFieldExprMatch(t *testing.T) {
+	check := func(expr, raw string, expected bool) {
+		fe, err := parseFieldExpr(expr)
+		require.NoError(t, err)
+		assert.Equal(t, expected, fe.match([]byte(raw)), "%q matching %q", expr, raw)
+	}
+
+	check("x", "1", true)
+	check("x", `"s"`, true)
+
+	check("x > 1e9", "1e10", true)
+	check("x > 1e9", "1000000001i", true)
+	check("x > 1e9", "1000000000i", false)
+	check("x > 1e9", "999", false)
+	check("x == 5", "5i", true)
+	check("x == 5", "5.0", true)
+	check("x == 5", "5u", true)
+	check("x == 5i", "5", true)
+	check("x != 5", "6i", true)
+	check("x < -1.5", "-2", true)
+	check("x < -1.5", "-1i", false)
+	check("x >= 9223372036854775807", "9223372036854775807i", true)
+	check("x > 9223372036854775806", "9223372036854775807i", true)
+	check("x < 0", "18446744073709551615u", false)
+	check("x == 1", `"1"`, false)
+	check("x == 1", "t", false)
+	check("x == 1", "", false)
+	check("x == 1", "1x", false)
+
+	check(`x == "error"`, `"error"`, true)
+	check(`x == "error"`, `"errors"`, false)
+	check(`x == "a\"b\\c"`, `"a\"b\\c"`, true)
+	check(`x != "error"`, `"ok"`, true)
+	check(`x != "error"`, `"error"`, false)
+	check(`x != "error"`, "1", false)
+	check(`x == "1"`, "1", false)
+	check(`x == ""`, `""`, true)
+	check(`x == "a"`, `"`, false)
+
+	check("x == true", "t", true)
+	check("x == true", "True", true)
+	check("x == true", "TRUE", true)
+	check("x == true", "f", false)
+	check("x != true", "false", true)
+	check("x == false", "F", true)
+	check("x == true", "1", false)
+	check("x == true", `"true"`, false)
+}
@@ -108,6 +108,79 @@ spout_stat_filter_rule,rule=hello-subject triggered=2
 `)
 }
 
+func TestFilterWorkerFanOut(t *testing.T) {
+	gnatsd := spouttest.RunGnatsd(natsPort)
+	defer gnatsd.Shutdown()
+
+	conf := conf
+	conf.Rule = []config.Rule{{
+		Rtype:    "basic",
+		Match:    "hello",
+		Subject:  "realtime-subject",
+		Continue: true,
+	}, {
+		Rtype:   "regex",
+		Match:   "host=gopher",
+		Subject: "archive-subject",
+	}}
+
+	filter, err := StartFilter(&conf)
+	require.NoError(t, err)
+	defer filter.Stop()
+
+	nc, err := nats.Connect(conf.NATSAddress)
+	require.NoError(t, err)
+	defer nc.Close()
+
+	realtimeCh := make(chan string, 1)
+	_, err = nc.Subscribe("realtime-subject", func(msg *nats.Msg) {
+		realtimeCh <- string(msg.Data)
+	})
+	require.NoError(t, err)
+
+	archiveCh := make(chan string, 1)
+	_, err = nc.Subscribe("archive-subject", func(msg *nats.Msg) {
+		archiveCh <- string(msg.Data)
+	})
+	require.NoError(t, err)
+
+	statsCh := make(chan string, 10)
+	_, err = nc.Subscribe(conf.NATSSubjectMonitor, func(msg *nats.Msg) {
+		statsCh <- string(msg.Data)
+	})
+	require.NoError(t, err)
+
+	lines := `
+hello,host=gopher01
+goodbye,host=gopher01
+hello,host=other
+goodbye,host=other
+`[1:]
+	err = nc.Publish(conf.NATSSubject[0], []byte(lines))
+	require.NoError(t, err)
+
+	// Lines matching the first rule are also sent to the second.
+	assertReceived(t, realtimeCh, "realtime data", `
+hello,host=gopher01
+hello,host=other
+`)
+	assertReceived(t, archiveCh, "archive data", `
+hello,host=gopher01
+goodbye,host=gopher01
+`)
+
+	// Lines are only counted once in the totals.
+	assertReceived(t, statsCh, "stats", `
+spout_stat_filter passed=3,processed=4,rejected=1
+`)
+	assertReceived(t, statsCh, "rule stats", `
+spout_stat_filter_rule,rule=realtime-subject triggered=2
+`)
+	assertReceived(t, statsCh, "rule stats", `
+spout_stat_filter_rule,rule=archive-subject triggered=2
+`)
+}
+
 func assertReceived(t *testing.T, ch <-chan string, label, expected string) {
 	expected = expected[1:]
 	select {
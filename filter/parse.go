@@ -0,0 +1,115 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import "bytes"
+
+// tagValue takes an *escaped* line protocol line and returns the
+// *unescaped* value of the tag with the (unescaped) name key. false is
+// returned if the line doesn't have the tag.
+func tagValue(line, key []byte) ([]byte, bool) {
+	i := len(measurementName(line))
+	for i < len(line) && line[i] == ',' {
+		keyStart := i + 1
+		i = scanTagPart(line, keyStart)
+		if i >= len(line) || line[i] != '=' {
+			return nil, false // malformed tag
+		}
+		keyEnd := i
+
+		valueStart := i + 1
+		i = scanTagPart(line, valueStart)
+		if bytes.Equal(influxUnescape(line[keyStart:keyEnd]), key) {
+			return influxUnescape(line[valueStart:i]), true
+		}
+	}
+	return nil, false
+}
+
+// scanTagPart returns the index of the first character at or after i
+// which ends a tag key or value (an unescaped comma, equals sign or
+// space), or the end of the line.
+func scanTagPart(line []byte, i int) int {
+	for ; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case ',', '=', ' ', '\n':
+			return i
+		}
+	}
+	return len(line)
+}
+
+// fieldValue takes an *escaped* line protocol line and returns the
+// raw value of the field with the (unescaped) name key. String values
+// are returned with their quotes. false is returned if the line
+// doesn't have the field.
+func fieldValue(line, key []byte) ([]byte, bool) {
+	// Skip over the measurement and tags.
+	i := len(measurementName(line))
+	for i < len(line) && line[i] != ' ' {
+		if line[i] == '\n' {
+			return nil, false
+		}
+		i = scanTagPart(line, i+1)
+	}
+	if i >= len(line) {
+		return nil, false
+	}
+
+	for {
+		keyStart := i + 1
+		i = scanTagPart(line, keyStart)
+		if i >= len(line) || line[i] != '=' {
+			return nil, false // malformed field
+		}
+		keyEnd := i
+
+		valueStart := i + 1
+		i = scanFieldValue(line, valueStart)
+		if bytes.Equal(influxUnescape(line[keyStart:keyEnd]), key) {
+			return line[valueStart:i], true
+		}
+		if i >= len(line) || line[i] != ',' {
+			return nil, false
+		}
+	}
+}
+
+// scanFieldValue returns the index of the first character after the
+// field value starting at i. String values may contain any character,
+// including escaped quotes.
+func scanFieldValue(line []byte, i int) int {
+	if i < len(line) && line[i] == '"' {
+		for i++; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++ // skip the escaped character
+			case '"':
+				return i + 1
+			}
+		}
+		return len(line)
+	}
+
+	for ; i < len(line); i++ {
+		switch line[i] {
+		case ',', ' ', '\n':
+			return i
+		}
+	}
+	return len(line)
+}
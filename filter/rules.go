@@ -15,9 +15,11 @@
 package filter
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"hash/fnv"
 	"regexp"
+	"strings"
 
 	"github.com/jumptrading/influx-spout/config"
 )
@@ -33,31 +35,51 @@ type Rule struct {
 	// is passed otherwise.
 	escaped bool
 
+	// basic is true for basic rules, which match lines with the
+	// (unescaped) measurement name measurement. RuleSet uses this to
+	// check runs of basic rules using a single map lookup.
+	basic       bool
+	measurement string
+
+	// op is set for rules which combine the rules in rules (the
+	// match function isn't used in this case).
+	op    ruleOp
+	rules []Rule
+
 	// if the rule matches, the measurement is sent to this NATS subject
 	subject string
+
+	// cont is true if later rules should still be checked after this
+	// rule matches (see RuleSet.LookupAll).
+	cont bool
 }
 
+// ruleOp says how a Rule is evaluated.
+type ruleOp int
+
+const (
+	opMatch ruleOp = iota // call match
+	opAll                 // all of rules must match
+	opAny                 // any of rules must match
+	opNot                 // rules[0] must not match
+)
+
 // CreateBasicRule creates a simple rule that publishes measurements
 // with the name @measurement to the NATS @subject.
 func CreateBasicRule(measurement string, subject string) Rule {
-	hh := hashMeasurement([]byte(measurement))
+	mm := []byte(measurement)
 
 	return Rule{
 		match: func(line []byte) bool {
-			name := influxUnescape(measurementName(line))
-			return hh == hashMeasurement(name)
+			return bytes.Equal(influxUnescape(measurementName(line)), mm)
 		},
-		escaped: true,
-		subject: subject,
+		escaped:     true,
+		basic:       true,
+		measurement: measurement,
+		subject:     subject,
 	}
 }
 
-func hashMeasurement(measurement []byte) uint32 {
-	hh := fnv.New32()
-	hh.Write(measurement)
-	return hh.Sum32()
-}
-
 // measurementName takes an *escaped* line protocol line and returns
 // the *escaped* measurement from it.
 func measurementName(s []byte) []byte {
@@ -113,34 +135,305 @@ func CreateNegativeRegexRule(regexString, subject string) Rule {
 	}
 }
 
+// CreateTagRule creates a rule that publishes measurements with a tag
+// named @key whose value matches @match to the NATS @subject. How the
+// value is matched depends on @matchType:
+//
+//     exact  the value must equal @match (the default)
+//     glob   @match is a pattern where * matches any sequence of
+//            characters and ? matches any single character
+//     regex  @match is a regular expression applied to the value
+//
+// Unlike a regex rule, only the tag's value is considered so field
+// values and other tags can't match by accident.
+func CreateTagRule(key, match, matchType, subject string) (Rule, error) {
+	if key == "" {
+		return Rule{}, errors.New("tag rules require a tag")
+	}
+
+	var matchValue func([]byte) bool
+	switch matchType {
+	case "", "exact":
+		value := []byte(match)
+		matchValue = func(v []byte) bool {
+			return bytes.Equal(v, value)
+		}
+	case "glob", "regex":
+		pattern := match
+		if matchType == "glob" {
+			pattern = globToRegex(match)
+		}
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return Rule{}, err
+		}
+		matchValue = reg.Match
+	default:
+		return Rule{}, fmt.Errorf("invalid match_type %q", matchType)
+	}
+
+	keyBytes := []byte(key)
+	return Rule{
+		match: func(line []byte) bool {
+			value, ok := tagValue(line, keyBytes)
+			return ok && matchValue(value)
+		},
+		escaped: true,
+		subject: subject,
+	}, nil
+}
+
+// CreateFieldRule creates a rule that publishes measurements with a
+// field that satisfies the expression @expr to the NATS @subject. The
+// expression has the form:
+//
+//     <field> [<op> <value>]
+//
+// where <op> is one of ==, !=, <, <=, > or >= and <value> is a number
+// (e.g. 42, 1.5 or 1e9, optionally with an "i" suffix), a double
+// quoted string or true/false. Strings and booleans may only be
+// compared with == and !=. Numbers are compared with both integer and
+// float fields. An expression with just a field name matches lines
+// which have the field, whatever its value.
+//
+// Lines without the field, or where the field's value is of a
+// different type to <value>, don't match.
+func CreateFieldRule(expr, subject string) (Rule, error) {
+	fe, err := parseFieldExpr(expr)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{
+		match: func(line []byte) bool {
+			value, ok := fieldValue(line, fe.key)
+			return ok && fe.match(value)
+		},
+		escaped: true,
+		subject: subject,
+	}, nil
+}
+
+// globToRegex converts a glob pattern to an equivalent anchored
+// regular expression.
+func globToRegex(glob string) string {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	return "^(?s:" + pattern + ")$"
+}
+
+// CreateAllRule creates a rule that publishes measurements which
+// match all of @rules to the NATS @subject. The subjects of @rules are
+// ignored. Evaluation stops at the first rule which doesn't match.
+func CreateAllRule(rules []Rule, subject string) Rule {
+	return Rule{
+		op:      opAll,
+		rules:   rules,
+		subject: subject,
+	}
+}
+
+// CreateAnyRule creates a rule that publishes measurements which
+// match any of @rules to the NATS @subject. The subjects of @rules are
+// ignored. Evaluation stops at the first rule which matches.
+func CreateAnyRule(rules []Rule, subject string) Rule {
+	return Rule{
+		op:      opAny,
+		rules:   rules,
+		subject: subject,
+	}
+}
+
+// CreateNotRule creates a rule that publishes measurements which
+// *don't* match @rule to the NATS @subject. The subject of @rule is
+// ignored.
+func CreateNotRule(rule Rule, subject string) Rule {
+	return Rule{
+		op:      opNot,
+		rules:   []Rule{rule},
+		subject: subject,
+	}
+}
+
+// Continue returns a copy of the rule which doesn't stop later rules
+// from being checked when it matches. This allows a line to be sent to
+// more than one subject.
+func (r Rule) Continue() Rule {
+	r.cont = true
+	return r
+}
+
+// matches reports whether the rule matches a line. Both the original,
+// escaped line and the unescaped line are provided so that rules
+// combining other rules can pass each sub-rule the version it needs.
+func (r *Rule) matches(escapedLine, line []byte) bool {
+	switch r.op {
+	case opAll:
+		for i := range r.rules {
+			if !r.rules[i].matches(escapedLine, line) {
+				return false
+			}
+		}
+		return true
+	case opAny:
+		for i := range r.rules {
+			if r.rules[i].matches(escapedLine, line) {
+				return true
+			}
+		}
+		return false
+	case opNot:
+		return !r.rules[0].matches(escapedLine, line)
+	}
+
+	if r.escaped {
+		return r.match(escapedLine)
+	}
+	return r.match(line)
+}
+
+// needsUnescaped returns true if the rule, or any of the rules it
+// combines, matches against the unescaped line.
+func (r *Rule) needsUnescaped() bool {
+	if r.op == opMatch {
+		return !r.escaped
+	}
+	for i := range r.rules {
+		if r.rules[i].needsUnescaped() {
+			return true
+		}
+	}
+	return false
+}
+
 // RureSetFromConfig creates a new RuleSet instance using the rules
 // from Config provided.
 func RuleSetFromConfig(conf *config.Config) (*RuleSet, error) {
 	rs := new(RuleSet)
 	for _, r := range conf.Rule {
-		switch r.Rtype {
-		case "basic":
-			rs.Append(CreateBasicRule(r.Match, r.Subject))
-		case "regex":
-			rs.Append(CreateRegexRule(r.Match, r.Subject))
-		case "negregex":
-			rs.Append(CreateNegativeRegexRule(r.Match, r.Subject))
-		default:
-			return nil, fmt.Errorf("Unsupported rule type: [%v]", r)
+		rule, err := ruleFromConfig(r)
+		if err != nil {
+			return nil, err
 		}
+		if r.Continue {
+			rule = rule.Continue()
+		}
+		rs.Append(rule)
 	}
 	return rs, nil
 }
 
+func ruleFromConfig(r config.Rule) (Rule, error) {
+	composed := 0
+	if len(r.All) > 0 {
+		composed++
+	}
+	if len(r.Any) > 0 {
+		composed++
+	}
+	if r.Not != nil {
+		composed++
+	}
+	if composed > 0 {
+		if r.Rtype != "" || composed > 1 {
+			return Rule{}, errors.New("rules may only have one of type, all, any or not")
+		}
+		return composedRuleFromConfig(r)
+	}
+
+	switch r.Rtype {
+	case "basic":
+		return CreateBasicRule(r.Match, r.Subject), nil
+	case "regex":
+		return CreateRegexRule(r.Match, r.Subject), nil
+	case "negregex":
+		return CreateNegativeRegexRule(r.Match, r.Subject), nil
+	case "tag":
+		rule, err := CreateTagRule(r.Tag, r.Match, r.MatchType, r.Subject)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid tag rule: %v", err)
+		}
+		return rule, nil
+	case "field":
+		rule, err := CreateFieldRule(r.Match, r.Subject)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid field rule: %v", err)
+		}
+		return rule, nil
+	default:
+		return Rule{}, fmt.Errorf("Unsupported rule type: [%v]", r)
+	}
+}
+
+func composedRuleFromConfig(r config.Rule) (Rule, error) {
+	if r.Not != nil {
+		rule, err := ruleFromConfig(*r.Not)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid not rule: %v", err)
+		}
+		return CreateNotRule(rule, r.Subject), nil
+	}
+
+	name, subConfs, create := "all", r.All, CreateAllRule
+	if len(r.Any) > 0 {
+		name, subConfs, create = "any", r.Any, CreateAnyRule
+	}
+	rules := make([]Rule, len(subConfs))
+	for i, subConf := range subConfs {
+		var err error
+		rules[i], err = ruleFromConfig(subConf)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid %s rule: %v", name, err)
+		}
+	}
+	return create(rules, r.Subject), nil
+}
+
 // RuleSet is a container for a number of Rules. Rules are kept in the
 // order they were appended.
 type RuleSet struct {
 	rules []Rule
+
+	// segments divides rules into runs of consecutive basic rules and
+	// runs of other rules.
+	segments []ruleSegment
+
+	// unescape is true if any of the rules match against the
+	// unescaped line.
+	unescape bool
+}
+
+// ruleSegment is a run of rules in a RuleSet. For runs of basic rules,
+// basic maps each measurement name to the indexes of the rules for it,
+// in order.
+type ruleSegment struct {
+	start, end int
+	basic      map[string][]int
 }
 
 // Append adds a rule to the end of a RuleSet.
 func (rs *RuleSet) Append(rule Rule) {
+	i := len(rs.rules)
 	rs.rules = append(rs.rules, rule)
+	if rule.needsUnescaped() {
+		rs.unescape = true
+	}
+
+	var last *ruleSegment
+	if len(rs.segments) > 0 {
+		last = &rs.segments[len(rs.segments)-1]
+	}
+	if last == nil || rule.basic != (last.basic != nil) {
+		rs.segments = append(rs.segments, ruleSegment{start: i})
+		last = &rs.segments[len(rs.segments)-1]
+		if rule.basic {
+			last.basic = make(map[string][]int)
+		}
+	}
+	last.end = i + 1
+	if rule.basic {
+		last.basic[rule.measurement] = append(last.basic[rule.measurement], i)
+	}
 }
 
 // Count returns the number of rules in the RuleSet.
@@ -157,18 +450,64 @@ func (rs *RuleSet) Subjects() []string {
 	return out
 }
 
-// Lookup takes a raw line and returns the index of the rule in the
-// RuleSet that matches it. Returns -1 if there was no match.
+// Lookup takes a raw line and returns the index of the first rule in
+// the RuleSet that matches it. Returns -1 if there was no match.
+//
+// The line is unescaped at most once, and only if a rule needs it.
 func (rs *RuleSet) Lookup(escapedLine []byte) int {
-	line := influxUnescape(escapedLine)
-	for i, rule := range rs.rules {
-		matchLine := line
-		if rule.escaped {
-			matchLine = escapedLine
+	var buf [1]int
+	matches := rs.lookup(escapedLine, buf[:0], false)
+	if len(matches) == 0 {
+		return -1
+	}
+	return matches[0]
+}
+
+// LookupAll takes a raw line and appends the indexes of the rules in
+// the RuleSet that match it to matches, returning the extended slice.
+// Rules are checked in order until a rule which matches and isn't a
+// continue rule (see Rule.Continue) is found.
+func (rs *RuleSet) LookupAll(escapedLine []byte, matches []int) []int {
+	return rs.lookup(escapedLine, matches, true)
+}
+
+// lookup appends the indexes of the rules matching a line to matches.
+// Only the first matching rule is appended unless all is true, in
+// which case matching continues after continue rules.
+//
+// Runs of basic rules are checked with a single map lookup, using the
+// measurement name which is found at most once per line.
+func (rs *RuleSet) lookup(escapedLine []byte, matches []int, all bool) []int {
+	line := escapedLine
+	if rs.unescape {
+		line = influxUnescape(escapedLine)
+	}
+
+	var name []byte
+	haveName := false
+	for _, seg := range rs.segments {
+		if seg.basic != nil {
+			if !haveName {
+				name = influxUnescape(measurementName(escapedLine))
+				haveName = true
+			}
+			for _, i := range seg.basic[string(name)] {
+				matches = append(matches, i)
+				if !all || !rs.rules[i].cont {
+					return matches
+				}
+			}
+			continue
 		}
-		if rule.match(matchLine) {
-			return i
+
+		for i := seg.start; i < seg.end; i++ {
+			if rs.rules[i].matches(escapedLine, line) {
+				matches = append(matches, i)
+				if !all || !rs.rules[i].cont {
+					return matches
+				}
+			}
 		}
 	}
-	return -1
+	return matches
 }
@@ -17,10 +17,13 @@
 package filter
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/jumptrading/influx-spout/config"
 )
 
 func TestBasicRuleCreation(t *testing.T) {
@@ -100,6 +103,322 @@ func TestNegativeRegexRuleUnescapes(t *testing.T) {
 	assert.Equal(t, 0, rs.Lookup([]byte("bye,host=gopher01 x=hello")))
 }
 
+func TestTagRule(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(t, "host", "web01", ""))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=web01 x=1")))
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,dc=ny4,host=web01,rack=2 x=1")))
+
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=web012 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,myhost=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=host x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("host=web01 x=1")))
+
+	// Fields can't match.
+	assert.Equal(t, -1, rs.Lookup([]byte(`cpu host="web01"`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`cpu,dc=ny4 x=1,host=web01`)))
+}
+
+func TestTagRuleEscaping(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(t, "host name", "web,01 =x", ""))
+
+	assert.Equal(t, 0, rs.Lookup([]byte(`cpu,host\ name=web\,01\ \=x x=1`)))
+	assert.Equal(t, 0, rs.Lookup([]byte(`c\,p\ u,a=b\,host\ name\=c,host\ name=web\,01\ \=x x=1`)))
+
+	assert.Equal(t, -1, rs.Lookup([]byte(`cpu,host\ name=web\,01 x=1`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`cpu\,host\ name=web\,01\ \=x x=1`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`cpu,a=host\ name=web\,01\ \=x x=1`)))
+}
+
+func TestTagRuleGlob(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(t, "host", "web*.prod.?", "glob"))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=web01.prod.a x=1")))
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=web.prod.b x=1")))
+	assert.Equal(t, 0, rs.Lookup([]byte(`cpu,host=web\ 1.prod.c x=1`)))
+
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=web01.prod x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=web01.prod.ab x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=xweb01.prod.a x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=web01xprodxa x=1")))
+}
+
+func TestTagRuleRegex(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(t, "host", "^web[0-9]+$", "regex"))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,host=web01a x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=web01 x=1")))
+}
+
+func TestTagRuleErrors(t *testing.T) {
+	_, err := CreateTagRule("", "x", "", "")
+	assert.EqualError(t, err, "tag rules require a tag")
+
+	_, err = CreateTagRule("host", "x", "fuzzy", "")
+	assert.EqualError(t, err, `invalid match_type "fuzzy"`)
+
+	_, err = CreateTagRule("host", "(", "regex", "")
+	assert.Error(t, err)
+}
+
+func TestTagValue(t *testing.T) {
+	check := func(line, key, expected string, expectedOK bool) {
+		value, ok := tagValue([]byte(line), []byte(key))
+		assert.Equal(t, expectedOK, ok, "tagValue(%q, %q)", line, key)
+		assert.Equal(t, expected, string(value), "tagValue(%q, %q)", line, key)
+	}
+
+	check("cpu,a=1,b=2 x=1", "a", "1", true)
+	check("cpu,a=1,b=2 x=1", "b", "2", true)
+	check("cpu,a=1,b=2", "b", "2", true)
+	check("cpu,a=1,b=2\n", "b", "2", true)
+	check("cpu,a=,b=2 x=1", "a", "", true)
+	check(`cpu,a\==\=,b=2 x=1`, "a=", "=", true)
+	check("cpu,a=1 x=1", "x", "", false)
+	check("cpu x=1", "x", "", false)
+	check("cpu", "cpu", "", false)
+	check("cpu,a x=1", "a", "", false)
+	check("", "a", "", false)
+}
+
+func mustCreateTagRule(t testing.TB, key, match, matchType string) Rule {
+	rule, err := CreateTagRule(key, match, matchType, "")
+	require.NoError(t, err)
+	return rule
+}
+
+func TestFieldRule(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateFieldRule(t, "value > 1e9"))
+	rs.Append(mustCreateFieldRule(t, `status == "error"`))
+	rs.Append(mustCreateFieldRule(t, "up"))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("bytes,host=a value=2e9")))
+	assert.Equal(t, 0, rs.Lookup([]byte("bytes,host=a x=1,value=1000000001i 1500000000")))
+	assert.Equal(t, 1, rs.Lookup([]byte(`bytes,host=a value=1e9,status="error"`)))
+	assert.Equal(t, 1, rs.Lookup([]byte(`app msg="a, b=c",status="error"`)))
+	assert.Equal(t, 2, rs.Lookup([]byte(`app status="ok",up=f`)))
+
+	assert.Equal(t, -1, rs.Lookup([]byte("bytes,host=a value=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte(`bytes,value=2e9,status=error x=1`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`app msg="status=\"error\""`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`app status="err`)))
+}
+
+func TestFieldRuleErrors(t *testing.T) {
+	_, err := CreateFieldRule("value = 1", "")
+	assert.EqualError(t, err, `invalid operator "="`)
+}
+
+func mustCreateFieldRule(t testing.TB, expr string) Rule {
+	rule, err := CreateFieldRule(expr, "")
+	require.NoError(t, err)
+	return rule
+}
+
+func TestAllRule(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateAllRule([]Rule{
+		CreateBasicRule("cpu", ""),
+		mustCreateTagRule(t, "dc", "ny4", ""),
+		CreateNotRule(mustCreateTagRule(t, "host", "^test", "regex"), ""),
+	}, ""))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,dc=ny4,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("mem,dc=ny4,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=ld4,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=ny4,host=test01 x=1")))
+}
+
+func TestAnyRule(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateAnyRule([]Rule{
+		CreateBasicRule("cpu", ""),
+		CreateRegexRule("host=web", ""),
+	}, ""))
+
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=db01 x=1")))
+	assert.Equal(t, 0, rs.Lookup([]byte("mem,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("mem,host=db01 x=1")))
+}
+
+func TestNotRule(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateNotRule(CreateBasicRule("cpu", ""), ""))
+
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu x=1")))
+	assert.Equal(t, 0, rs.Lookup([]byte("mem x=1")))
+}
+
+func TestComposedRuleEscaping(t *testing.T) {
+	// Sub-rules must each see the version of the line they expect,
+	// whatever the nesting.
+	rs := new(RuleSet)
+	rs.Append(CreateAllRule([]Rule{
+		CreateAnyRule([]Rule{
+			CreateNotRule(CreateNotRule(CreateRegexRule(`^c,pu `, ""), ""), ""),
+			CreateBasicRule("mem", ""),
+		}, ""),
+		CreateBasicRule("c,pu", ""),
+	}, ""))
+
+	assert.Equal(t, 0, rs.Lookup([]byte(`c\,pu x=1`)))
+	assert.Equal(t, -1, rs.Lookup([]byte(`c,pu x=1`)))
+}
+
+func TestComposedRuleShortCircuit(t *testing.T) {
+	calls := 0
+	counter := Rule{
+		match: func([]byte) bool {
+			calls++
+			return true
+		},
+	}
+	rs := new(RuleSet)
+	rs.Append(CreateAllRule([]Rule{CreateBasicRule("cpu", ""), counter}, ""))
+	rs.Append(CreateAnyRule([]Rule{CreateBasicRule("mem", ""), counter}, ""))
+
+	assert.Equal(t, 1, rs.Lookup([]byte("mem x=1")))
+	assert.Equal(t, 0, calls)
+}
+
+func TestRuleSetUnescape(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateBasicRule("cpu", ""))
+	rs.Append(CreateAllRule([]Rule{
+		mustCreateTagRule(t, "dc", "ny4", ""),
+		CreateNotRule(mustCreateFieldRule(t, "x"), ""),
+	}, ""))
+	assert.False(t, rs.unescape)
+
+	rs.Append(CreateAnyRule([]Rule{
+		CreateBasicRule("mem", ""),
+		CreateNotRule(CreateRegexRule("x", ""), ""),
+	}, ""))
+	assert.True(t, rs.unescape)
+}
+
+func TestLookupAll(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateBasicRule("cpu", "realtime").Continue())
+	rs.Append(CreateRegexRule("host=web", "web").Continue())
+	rs.Append(CreateBasicRule("cpu", "archive"))
+	rs.Append(CreateBasicRule("cpu", "never"))
+
+	check := func(line string, expected ...int) {
+		matches := rs.LookupAll([]byte(line), nil)
+		assert.Equal(t, expected, matches, "LookupAll(%q)", line)
+	}
+	check("cpu,host=web01 x=1", 0, 1, 2)
+	check("cpu,host=db01 x=1", 0, 2)
+	check("mem,host=web01 x=1", 1)
+	check("mem,host=db01 x=1")
+
+	// Lookup still returns the first match.
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,host=web01 x=1")))
+	assert.Equal(t, 1, rs.Lookup([]byte("mem,host=web01 x=1")))
+
+	// The matches slice is appended to.
+	matches := make([]int, 1, 4)
+	matches = rs.LookupAll([]byte("cpu x=1"), matches[:0])
+	assert.Equal(t, []int{0, 2}, matches)
+}
+
+func TestBasicRuleOrdering(t *testing.T) {
+	rs := new(RuleSet)
+	rs.Append(CreateBasicRule("cpu", ""))             // 0
+	rs.Append(CreateBasicRule("mem", "").Continue())  // 1
+	rs.Append(CreateRegexRule("host=web", ""))        // 2
+	rs.Append(CreateBasicRule("mem", ""))             // 3
+	rs.Append(CreateBasicRule("disk", "").Continue()) // 4
+	rs.Append(CreateBasicRule("disk", ""))            // 5
+	rs.Append(CreateBasicRule("cpu", ""))             // 6
+	rs.Append(CreateBasicRule("c,p u", ""))           // 7
+	assert.Len(t, rs.segments, 3)
+
+	check := func(line string, expected int, expectedAll ...int) {
+		assert.Equal(t, expected, rs.Lookup([]byte(line)), "Lookup(%q)", line)
+		assert.Equal(t, expectedAll, rs.LookupAll([]byte(line), nil), "LookupAll(%q)", line)
+	}
+	check("cpu,host=web01 x=1", 0, 0)
+	check("mem,host=web01 x=1", 1, 1, 2)
+	check("mem,host=db01 x=1", 1, 1, 3)
+	check("disk,host=web01 x=1", 2, 2)
+	check("disk,host=db01 x=1", 4, 4, 5)
+	check(`c\,p\ u x=1`, 7, 7)
+	check("net,host=db01 x=1", -1)
+	check("cpux x=1", -1)
+}
+
+func TestRuleSetFromConfig(t *testing.T) {
+	conf := &config.Config{Rule: []config.Rule{
+		{Rtype: "basic", Match: "cpu", Subject: "a"},
+		{Rtype: "tag", Tag: "host", Match: "web*", MatchType: "glob", Subject: "b"},
+		{Rtype: "field", Match: "value > 10", Subject: "c"},
+	}}
+	rs, err := RuleSetFromConfig(conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, rs.Subjects())
+	assert.Equal(t, 1, rs.Lookup([]byte("mem,host=web01 x=1")))
+	assert.Equal(t, 2, rs.Lookup([]byte("mem,host=db01 value=11")))
+
+	conf.Rule[2].Match = "value >"
+	_, err = RuleSetFromConfig(conf)
+	assert.EqualError(t, err, "invalid field rule: missing value")
+
+	conf.Rule[2].Match = "value > 10"
+	conf.Rule[0].Continue = true
+	rs, err = RuleSetFromConfig(conf)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, rs.LookupAll([]byte("cpu,host=web01 x=1"), nil))
+
+	conf.Rule[1].MatchType = "fuzzy"
+	_, err = RuleSetFromConfig(conf)
+	assert.EqualError(t, err, `invalid tag rule: invalid match_type "fuzzy"`)
+}
+
+func TestComposedRuleSetFromConfig(t *testing.T) {
+	conf := &config.Config{Rule: []config.Rule{{
+		Subject: "cpu-ny4",
+		All: []config.Rule{
+			{Rtype: "basic", Match: "cpu"},
+			{Any: []config.Rule{
+				{Rtype: "tag", Tag: "dc", Match: "ny4"},
+				{Rtype: "tag", Tag: "dc", Match: "ny5"},
+			}},
+			{Not: &config.Rule{Rtype: "tag", Tag: "host", Match: "^test", MatchType: "regex"}},
+		},
+	}}}
+	rs, err := RuleSetFromConfig(conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cpu-ny4"}, rs.Subjects())
+	assert.Equal(t, 0, rs.Lookup([]byte("cpu,dc=ny5,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=ld4,host=web01 x=1")))
+	assert.Equal(t, -1, rs.Lookup([]byte("cpu,dc=ny4,host=test01 x=1")))
+}
+
+func TestComposedRuleSetFromConfigErrors(t *testing.T) {
+	check := func(rule config.Rule, expected string) {
+		_, err := RuleSetFromConfig(&config.Config{Rule: []config.Rule{rule}})
+		assert.EqualError(t, err, expected)
+	}
+
+	basic := config.Rule{Rtype: "basic", Match: "cpu"}
+	check(config.Rule{Rtype: "basic", All: []config.Rule{basic}},
+		"rules may only have one of type, all, any or not")
+	check(config.Rule{Any: []config.Rule{basic}, Not: &basic},
+		"rules may only have one of type, all, any or not")
+	check(config.Rule{All: []config.Rule{{Any: []config.Rule{{Rtype: "field", Match: "x >"}}}}},
+		"invalid all rule: invalid any rule: invalid field rule: missing value")
+	check(config.Rule{Not: &config.Rule{Rtype: "foo"}},
+		"invalid not rule: Unsupported rule type: [{foo     false [] [] <nil>}]")
+}
+
 func TestMultipleRules(t *testing.T) {
 	rs := new(RuleSet)
 	rs.Append(CreateBasicRule("hello", "a"))
@@ -150,10 +469,46 @@ func TestMeasurementName(t *testing.T) {
 var result int
 
 func BenchmarkLineLookup(b *testing.B) {
-	rs := new(RuleSet)
-	rs.Append(CreateBasicRule("hello", ""))
-	line := []byte("hello world=42")
+	b.Run("single", func(b *testing.B) {
+		rs := new(RuleSet)
+		rs.Append(CreateBasicRule("hello", ""))
+		benchmarkLookup(b, rs, []byte("hello world=42"))
+	})
+
+	// Consecutive basic rules, where the line matches the last rule or
+	// none of them.
+	for _, count := range []int{10, 100, 1000} {
+		rs := new(RuleSet)
+		for i := 0; i < count; i++ {
+			rs.Append(CreateBasicRule(fmt.Sprintf("measurement%d", i), ""))
+		}
+		lastLine := []byte(fmt.Sprintf("measurement%d,host=web01 world=42", count-1))
+		missLine := []byte("other,host=web01 world=42")
+
+		b.Run(fmt.Sprintf("basic-%d-last", count), func(b *testing.B) {
+			benchmarkLookup(b, rs, lastLine)
+		})
+		b.Run(fmt.Sprintf("basic-%d-miss", count), func(b *testing.B) {
+			benchmarkLookup(b, rs, missLine)
+		})
+	}
+
+	b.Run("mixed", func(b *testing.B) {
+		// Runs of basic rules separated by a regex rule. The line
+		// matches a rule in the second run.
+		rs := new(RuleSet)
+		for i := 0; i < 100; i++ {
+			rs.Append(CreateBasicRule(fmt.Sprintf("measurement%d", i), ""))
+		}
+		rs.Append(CreateRegexRule("host=db", ""))
+		for i := 100; i < 200; i++ {
+			rs.Append(CreateBasicRule(fmt.Sprintf("measurement%d", i), ""))
+		}
+		benchmarkLookup(b, rs, []byte("measurement150,host=web01 world=42"))
+	})
+}
 
+func benchmarkLookup(b *testing.B, rs *RuleSet, line []byte) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		result = rs.Lookup(line)
@@ -182,6 +537,75 @@ func BenchmarkLineLookupNegativeRegex(b *testing.B) {
 	}
 }
 
+// benchmarkTagLine is a typical line with tags, used to compare tag
+// rules against the equivalent regex rules.
+var benchmarkTagLine = []byte("cpu,cpu=cpu-total,dc=ny4,host=web01.prod,rack=r12 " +
+	"usage_user=1.5,usage_system=0.8,usage_idle=97.7 1500000000000000000")
+
+func BenchmarkLineLookupTag(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(b, "host", "web01.prod", ""))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
+func BenchmarkLineLookupTagGlob(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateTagRule(b, "host", "web*", "glob"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
+func BenchmarkLineLookupTagRegexEquivalent(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(CreateRegexRule(`^[^ ]*,host=web01\.prod[, ]`, ""))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
+func BenchmarkLineLookupTagGlobRegexEquivalent(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(CreateRegexRule(`^[^ ]*,host=web[^, ]*[, ]`, ""))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
+func BenchmarkLineLookupField(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(mustCreateFieldRule(b, "usage_idle < 50"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
+func BenchmarkLineLookupComposed(b *testing.B) {
+	rs := new(RuleSet)
+	rs.Append(CreateAllRule([]Rule{
+		CreateBasicRule("cpu", ""),
+		mustCreateTagRule(b, "dc", "ny4", ""),
+		CreateNotRule(mustCreateTagRule(b, "host", "test*", "glob"), ""),
+	}, ""))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result = rs.Lookup(benchmarkTagLine)
+	}
+}
+
 func BenchmarkProcessBatch(b *testing.B) {
 	// Run the Filter worker with a fake NATS connection.
 	rs := new(RuleSet)
@@ -29,6 +29,7 @@ type worker struct {
 	junkSubject string
 	batches     []*bytes.Buffer
 	junkBatch   *bytes.Buffer
+	matches     []int
 }
 
 func newWorker(
@@ -88,19 +89,21 @@ func (w *worker) processBatch(batch []byte) {
 func (w *worker) processLine(line []byte) {
 	w.stats.Inc(linesProcessed)
 
-	idx := w.rules.Lookup(line)
-	if idx == -1 {
+	w.matches = w.rules.LookupAll(line, w.matches[:0])
+	if len(w.matches) == 0 {
 		// no rule for this => junkyard
 		w.stats.Inc(linesRejected)
 		w.junkBatch.Write(line)
 		return
 	}
 
-	// write to the corresponding batch buffer
-	w.batches[idx].Write(line)
+	// write to the corresponding batch buffers
+	for _, idx := range w.matches {
+		w.batches[idx].Write(line)
+		w.stats.Inc(ruleToStatsName(idx))
+	}
 
 	w.stats.Inc(linesPassed)
-	w.stats.Inc(ruleToStatsName(idx))
 }
 
 func (w *worker) sendOff() {
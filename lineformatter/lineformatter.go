@@ -12,9 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package lineformatter only contains the LineFormatter type and its
-// tests. LineFormatter efficiently generates InfluxDB Line Protocol
-// entries.
+// Package lineformatter contains the LineFormatter type and the
+// escaping it uses. LineFormatter efficiently generates InfluxDB Line
+// Protocol entries.
 //
 // The byte slices generated look something like this:
 //     measurement,tag1=foo,tag2=bar field1=123,field2="string"
@@ -23,14 +23,24 @@ package lineformatter
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Characters which must be escaped with a backslash in each part of a
+// line (see Escape).
+const (
+	MeasurementSpecial = ", "
+	KeySpecial         = ",= " // tag names, tag values and field names
+	StringSpecial      = `"\` // string field values
+)
+
 // New creates a new LineFormatter initialised for the given
-// measurement, tag names and fields names.
+// measurement, tag names and fields names. These are escaped as
+// required.
 func New(measurement string, tags []string, fields ...string) *LineFormatter {
 	f := &LineFormatter{
-		prefix: []byte(measurement),
+		prefix: Escape(nil, measurement, MeasurementSpecial),
 		fields: make([][]byte, len(fields)),
 		tags:   make([][]byte, len(tags)),
 	}
@@ -41,24 +51,35 @@ func New(measurement string, tags []string, fields ...string) *LineFormatter {
 
 	// Precompute tag sections
 	for i, tag := range tags {
-		// TODO: escaping of tag names (not critical right now).
-		f.tags[i] = []byte("," + tag + "=")
+		f.tags[i] = append(Escape([]byte{','}, tag, KeySpecial), '=')
 		f.bufCap += len(tags[i]) + 16 // tag name + approx tag size
 	}
 
 	// Precompute label sections
 	for i, field := range fields {
-		// TODO: escaping of field names (not critical right now).
+		var buf []byte
 		if i > 0 {
-			f.fields[i] = []byte("," + field + "=")
-		} else {
-			f.fields[i] = []byte(field + "=")
+			buf = []byte{','}
 		}
+		f.fields[i] = append(Escape(buf, field, KeySpecial), '=')
 		f.bufCap += len(fields[i]) + 16 // field name + approx value size
 	}
 	return f
 }
 
+// Escape appends s to buf, preceding any of the characters in special
+// with a backslash. special is normally one of MeasurementSpecial,
+// KeySpecial or StringSpecial.
+func Escape(buf []byte, s, special string) []byte {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) != -1 {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return buf
+}
+
 // LineFormatter generates InfluxDB Line Protocol lines. It is ~80%
 // faster than using a `[]byte(fmt.Sprintf(...))` style approach.
 type LineFormatter struct {
@@ -77,8 +98,11 @@ type LineFormatter struct {
 //
 // The number of field values given must be equal to or less than the
 // number of fields passed to New. The following field types are
-// supported: int, int64, string, bool. A panic will occur if other
-// types are passed. Strings will be correctly quoted and escaped.
+// supported: int, int64, string, bool, float32, float64 and []byte
+// (added as is). Other types are formatted using fmt. Strings will be
+// correctly quoted and escaped.
+//
+// Tag values are escaped as required.
 //
 // Format is goroutine safe.
 func (f *LineFormatter) Format(tagVals []string, vals ...interface{}) []byte {
@@ -106,12 +130,7 @@ func (f *LineFormatter) format(buf []byte, tagVals []string, vals ...interface{}
 
 	for i, tagVal := range tagVals {
 		buf = append(buf, f.tags[i]...)
-		// Note: this loop is significantly faster than
-		// `append(buf, []byte(tagVal))`
-		for i := range tagVal {
-			// TODO: escaping of tag values (not critical right now).
-			buf = append(buf, tagVal[i])
-		}
+		buf = Escape(buf, tagVal, KeySpecial)
 	}
 
 	buf = append(buf, ' ')
@@ -125,12 +144,7 @@ func (f *LineFormatter) format(buf []byte, tagVals []string, vals ...interface{}
 			buf = strconv.AppendInt(buf, v, 10)
 		case string:
 			buf = append(buf, '"')
-			for i := range v {
-				if v[i] == '"' {
-					buf = append(buf, '\\')
-				}
-				buf = append(buf, v[i])
-			}
+			buf = Escape(buf, v, StringSpecial)
 			buf = append(buf, '"')
 		case bool:
 			if v {
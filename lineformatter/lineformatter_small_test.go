@@ -68,6 +68,7 @@ func TestStringField(t *testing.T) {
 	assertFormat(t, f.Format(nil, `foo bar`), `measurement f="foo bar"`)
 	assertFormat(t, f.Format(nil, `st"uff`), `measurement f="st\"uff"`)
 	assertFormat(t, f.Format(nil, `"stuff"`), `measurement f="\"stuff\""`)
+	assertFormat(t, f.Format(nil, `back\slash`), `measurement f="back\\slash"`)
 }
 
 func TestBoolField(t *testing.T) {
@@ -100,6 +101,22 @@ func TestTags(t *testing.T) {
 	assertFormat(t, f.Format([]string{"foo", "bar"}, true), "measurement,abc=foo,x=bar f=t")
 }
 
+func TestEscaping(t *testing.T) {
+	f := lineformatter.New("my measurement,x=y", []string{"tag name", "a,b=c"}, "field name", "d,e=f")
+
+	assertFormat(t, f.Format([]string{"some value", "x,y=z"}, 1, 2),
+		`my\ measurement\,x=y,tag\ name=some\ value,a\,b\=c=x\,y\=z field\ name=1,d\,e\=f=2`)
+}
+
+func TestEscape(t *testing.T) {
+	buf := []byte("prefix ")
+	buf = lineformatter.Escape(buf, "a b,c=d", lineformatter.MeasurementSpecial)
+	assert.Equal(t, `prefix a\ b\,c=d`, string(buf))
+
+	assert.Equal(t, `a\ b\,c\=d`, string(lineformatter.Escape(nil, "a b,c=d", lineformatter.KeySpecial)))
+	assert.Equal(t, `say \"hi\" \\o/`, string(lineformatter.Escape(nil, `say "hi" \o/`, lineformatter.StringSpecial)))
+}
+
 func TestTagsAndMultipleFields(t *testing.T) {
 	f := lineformatter.New("m", []string{"x", "y"}, "a", "b")
 
@@ -0,0 +1,161 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errAuthRequired = errors.New("unable to parse authentication credentials")
+	errAuthFailed   = errors.New("authorization failed")
+)
+
+// newAuthenticator creates an authenticator from plain text
+// credentials (from the config) and/or a file of bcrypt hashed
+// credentials. nil is returned if no credentials are configured,
+// meaning that authentication isn't required.
+func newAuthenticator(users map[string]string, credsFile string) (*authenticator, error) {
+	if len(users) == 0 && credsFile == "" {
+		return nil, nil
+	}
+
+	a := &authenticator{
+		plain:    users,
+		hashed:   make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	if credsFile != "" {
+		if err := a.loadCredentials(credsFile); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// authenticator checks the credentials supplied with HTTP requests.
+type authenticator struct {
+	plain  map[string]string // username -> password
+	hashed map[string][]byte // username -> bcrypt hash
+
+	// bcrypt is deliberately slow so a digest of the last password
+	// successfully verified for each user is kept. This avoids
+	// running bcrypt for every request.
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// loadCredentials reads a credentials file. Each line of the file
+// contains a username and bcrypt hashed password separated by a
+// colon (as generated by "htpasswd -B"). Blank lines and lines
+// starting with # are ignored.
+func (a *authenticator) loadCredentials(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 1 {
+			return fmt.Errorf("%s:%d: expected username:hash", fileName, lineNum)
+		}
+		hash := line[i+1:]
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return fmt.Errorf("%s:%d: invalid bcrypt hash: %v", fileName, lineNum, err)
+		}
+		a.hashed[string(line[:i])] = append([]byte(nil), hash...)
+	}
+	return scanner.Err()
+}
+
+// Authenticate checks the credentials supplied with a request. As
+// for InfluxDB, these may be given using the "u" and "p" query
+// parameters, HTTP basic authentication or an "Authorization: Token
+// username:password" header. The authenticated username is returned.
+func (a *authenticator) Authenticate(r *http.Request) (string, error) {
+	username, password, ok := requestCredentials(r)
+	if !ok {
+		return "", errAuthRequired
+	}
+	if !a.check(username, password) {
+		return "", errAuthFailed
+	}
+	return username, nil
+}
+
+func (a *authenticator) check(username, password string) bool {
+	if expected, ok := a.plain[username]; ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	}
+
+	hash, ok := a.hashed[username]
+	if !ok {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	a.mu.Lock()
+	last, ok := a.verified[username]
+	a.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(digest[:], last[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[username] = digest
+	a.mu.Unlock()
+	return true
+}
+
+func requestCredentials(r *http.Request) (string, string, bool) {
+	query := r.URL.Query()
+	if username := query.Get("u"); username != "" {
+		return username, query.Get("p"), true
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return username, password, true
+	}
+
+	const prefix = "Token "
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, prefix) {
+		creds := strings.SplitN(auth[len(prefix):], ":", 2)
+		if len(creds) == 2 {
+			return creds[0], creds[1], true
+		}
+	}
+	return "", "", false
+}
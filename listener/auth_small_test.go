@@ -0,0 +1,125 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticatorNotRequired(t *testing.T) {
+	a, err := newAuthenticator(nil, "")
+	require.NoError(t, err)
+	assert.Nil(t, a)
+}
+
+func TestAuthenticatorPlain(t *testing.T) {
+	a, err := newAuthenticator(map[string]string{"alice": "secret"}, "")
+	require.NoError(t, err)
+
+	assertAuthStyles(t, a, "alice", "secret")
+}
+
+func TestAuthenticatorHashed(t *testing.T) {
+	credsFile := writeCredsFile(t, "alice", "secret")
+	defer os.Remove(credsFile)
+
+	a, err := newAuthenticator(nil, credsFile)
+	require.NoError(t, err)
+
+	// Check twice to exercise the cache of verified passwords.
+	assertAuthStyles(t, a, "alice", "secret")
+	assertAuthStyles(t, a, "alice", "secret")
+}
+
+func TestAuthenticatorMissingCredentials(t *testing.T) {
+	a, err := newAuthenticator(map[string]string{"alice": "secret"}, "")
+	require.NoError(t, err)
+
+	assertAuthError(t, errAuthRequired, a, httptest.NewRequest("POST", "/write", nil))
+
+	r := httptest.NewRequest("POST", "/write", nil)
+	r.Header.Set("Authorization", "Token alice")
+	assertAuthError(t, errAuthRequired, a, r)
+}
+
+func TestAuthenticatorBadCredsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "creds")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nalice:not-a-hash\n")
+	f.Close()
+
+	_, err = newAuthenticator(nil, f.Name())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), f.Name()+":3: invalid bcrypt hash")
+
+	_, err = newAuthenticator(nil, "/does/not/exist")
+	assert.Error(t, err)
+}
+
+func assertAuthStyles(t *testing.T, a *authenticator, username, password string) {
+	query := httptest.NewRequest("POST", "/write?u="+username+"&p="+password, nil)
+	assertAuthenticated(t, a, query, username)
+	query = httptest.NewRequest("POST", "/write?u="+username+"&p=wrong", nil)
+	assertAuthError(t, errAuthFailed, a, query)
+
+	basic := httptest.NewRequest("POST", "/write", nil)
+	basic.SetBasicAuth(username, password)
+	assertAuthenticated(t, a, basic, username)
+	basic.SetBasicAuth(username, "wrong")
+	assertAuthError(t, errAuthFailed, a, basic)
+
+	token := httptest.NewRequest("POST", "/write", nil)
+	token.Header.Set("Authorization", "Token "+username+":"+password)
+	assertAuthenticated(t, a, token, username)
+	token.Header.Set("Authorization", "Token "+username+":wrong")
+	assertAuthError(t, errAuthFailed, a, token)
+
+	unknown := httptest.NewRequest("POST", "/write?u=mallory&p="+password, nil)
+	assertAuthError(t, errAuthFailed, a, unknown)
+}
+
+func assertAuthenticated(t *testing.T, a *authenticator, r *http.Request, username string) {
+	actual, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, username, actual)
+}
+
+func assertAuthError(t *testing.T, expected error, a *authenticator, r *http.Request) {
+	_, err := a.Authenticate(r)
+	assert.Equal(t, expected, err)
+}
+
+func writeCredsFile(t *testing.T, username, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "creds")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("# test credentials\n" + username + ":" + string(hash) + "\n")
+	require.NoError(t, err)
+	return f.Name()
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"sync"
+	"time"
+)
+
+func newBatch(subject string, size int) *batch {
+	return &batch{
+		subject: subject,
+		buf:     make([]byte, size),
+	}
+}
+
+// batch accumulates lines destined for a single NATS subject.
+//
+// mu must be held to access the batch when more than one goroutine may
+// use it (see Listener.appendBatch).
+type batch struct {
+	mu       sync.Mutex
+	subject  string
+	buf      []byte
+	size     int       // bytes used in buf
+	complete int       // bytes used in buf by complete lines
+	reads    int       // reads added since the batch was last sent
+	created  time.Time // when the first read was added
+
+	// Only used for batches which HTTP writes are routed to by
+	// database (see Listener.dbBatch).
+	templated bool      // the subject came from the subject template
+	lastUsed  time.Time // when lines were last added
+	evicted   bool      // the batch has been removed after being idle
+}
@@ -0,0 +1,358 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+// StartGraphiteListener initialises a listener configured to accept
+// Graphite plaintext protocol lines ("path value timestamp") over
+// both TCP and UDP on the same port. Lines are converted to InfluxDB
+// line protocol using the configured templates before being batched.
+// It starts the listener and its statistician and never returns.
+func StartGraphiteListener(c *config.Config) (_ *Listener, err error) {
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			listener.Stop()
+		}
+	}()
+
+	listener.graphite, err = newGraphiteParser(c.GraphiteTemplates, c.GraphiteSeparator)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := listener.setupTCP()
+	if err != nil {
+		return nil, err
+	}
+	sc, err := listener.setupUDP(c.ReadBufferBytes)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	listener.wg.Add(4)
+	go listener.startStatistician()
+	go listener.startBatchFlusher()
+	go listener.listenStream(ln)
+	go listener.listenDatagrams(sc)
+
+	log.Printf("Graphite listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+// convertGraphite appends the line protocol equivalent of each
+// Graphite line in lines to dst. Lines which can't be converted are
+// dropped and counted as rejected. The final line doesn't need to be
+// newline terminated.
+func (l *Listener) convertGraphite(dst, lines []byte) []byte {
+	now := time.Now()
+	for len(lines) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(lines, '\n'); i == -1 {
+			line, lines = lines, nil
+		} else {
+			line, lines = lines[:i+1], lines[i+1:]
+		}
+		if isBlankOrComment(line) {
+			continue
+		}
+
+		var err error
+		dst, err = l.graphite.Convert(dst, line, now)
+		if err != nil {
+			l.stats.Inc(linesRejected)
+			if l.c.Debug {
+				log.Printf("graphite listener: %v", parseError(line, err))
+			}
+		}
+	}
+	return dst
+}
+
+const (
+	graphiteDefaultTemplate = "measurement*"
+	graphiteDefaultField    = "value"
+)
+
+var (
+	errGraphiteFormat      = errors.New("expected path, value and optional timestamp")
+	errGraphiteValue       = errors.New("invalid value")
+	errGraphiteTimestamp   = errors.New("invalid timestamp")
+	errGraphiteMeasurement = errors.New("no measurement in path")
+)
+
+// newGraphiteParser creates a graphiteParser from Graphite templates
+// in the style used by InfluxDB. Each template has the form:
+//
+//     [filter] template [tag1=value1,tag2=value2]
+//
+// The template is a dot separated list of elements which name each
+// part of a Graphite path:
+//
+//     measurement   part of the measurement name
+//     measurement*  the rest of the path is part of the measurement name
+//     field         part of the field name
+//     field*        the rest of the path is part of the field name
+//     (empty)       the path part is ignored
+//     anything else the path part is the value of a tag with that name
+//
+// Where several parts make up the measurement, field or a tag, they
+// are joined using separator. The field is "value" if the template
+// doesn't name one.
+//
+// The filter is a dot separated list of patterns (see path.Match)
+// which select the paths a template applies to. The template with the
+// most specific (longest) filter matching a path is used. The template
+// without a filter is the default, used when no filter matches.
+func newGraphiteParser(templates []string, separator string) (*graphiteParser, error) {
+	p := &graphiteParser{separator: separator}
+	for _, text := range templates {
+		t, err := parseGraphiteTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid graphite template %q: %v", text, err)
+		}
+		if t.filter == nil {
+			if p.defaultTemplate != nil {
+				return nil, fmt.Errorf("invalid graphite template %q: more than one template without a filter", text)
+			}
+			p.defaultTemplate = t
+		} else {
+			p.templates = append(p.templates, t)
+		}
+	}
+	if p.defaultTemplate == nil {
+		p.defaultTemplate, _ = parseGraphiteTemplate(graphiteDefaultTemplate)
+	}
+	return p, nil
+}
+
+// graphiteParser converts Graphite plaintext lines to InfluxDB line
+// protocol.
+type graphiteParser struct {
+	separator       string
+	templates       []*graphiteTemplate // with filters
+	defaultTemplate *graphiteTemplate
+}
+
+type graphiteTemplate struct {
+	filter   []string // nil for the default template
+	elements []string
+	tags     map[string]string // added to every line
+}
+
+func parseGraphiteTemplate(text string) (*graphiteTemplate, error) {
+	t := new(graphiteTemplate)
+	var template, tags string
+
+	parts := strings.Fields(text)
+	switch len(parts) {
+	case 1:
+		template = parts[0]
+	case 2:
+		if strings.Contains(parts[1], "=") {
+			template, tags = parts[0], parts[1]
+		} else {
+			t.filter = strings.Split(parts[0], ".")
+			template = parts[1]
+		}
+	case 3:
+		t.filter = strings.Split(parts[0], ".")
+		template, tags = parts[1], parts[2]
+	default:
+		return nil, errors.New("expected [filter] template [tags]")
+	}
+
+	for _, pattern := range t.filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+
+	t.elements = strings.Split(template, ".")
+	var hasMeasurement, hasFieldWildcard, hasMeasurementWildcard bool
+	for _, element := range t.elements {
+		switch element {
+		case "measurement":
+			hasMeasurement = true
+		case "measurement*":
+			hasMeasurement, hasMeasurementWildcard = true, true
+		case "field*":
+			hasFieldWildcard = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, errors.New("no measurement specified")
+	}
+	if hasMeasurementWildcard && hasFieldWildcard {
+		return nil, errors.New("either measurement* or field* may be used, not both")
+	}
+
+	if tags != "" {
+		t.tags = make(map[string]string)
+		for _, tag := range strings.Split(tags, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			t.tags[kv[0]] = kv[1]
+		}
+	}
+	return t, nil
+}
+
+// matches returns true if the template's filter matches the parts of
+// a Graphite path.
+func (t *graphiteTemplate) matches(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if ok, _ := path.Match(pattern, parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *graphiteParser) template(parts []string) *graphiteTemplate {
+	var best *graphiteTemplate
+	for _, t := range p.templates {
+		if t.matches(parts) && (best == nil || len(t.filter) > len(best.filter)) {
+			best = t
+		}
+	}
+	if best == nil {
+		return p.defaultTemplate
+	}
+	return best
+}
+
+// Convert appends the line protocol equivalent of a single Graphite
+// line to dst. Graphite timestamps are in seconds. Lines without a
+// timestamp (or with a timestamp of -1) are given the timestamp now.
+func (p *graphiteParser) Convert(dst, line []byte, now time.Time) ([]byte, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 2 && len(fields) != 3 {
+		return dst, errGraphiteFormat
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return dst, errGraphiteValue
+	}
+
+	ts := now.UnixNano()
+	if len(fields) == 3 && fields[2] != "-1" {
+		secs, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || secs < 0 || secs > math.MaxInt64/float64(time.Second) {
+			return dst, errGraphiteTimestamp
+		}
+		ts = int64(secs * float64(time.Second))
+	}
+
+	parts := strings.Split(fields[0], ".")
+	measurement, field, tags := p.template(parts).apply(parts, p.separator)
+	if measurement == "" {
+		return dst, errGraphiteMeasurement
+	}
+
+	dst = lineformatter.Escape(dst, measurement, lineformatter.MeasurementSpecial)
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		dst = append(dst, ',')
+		dst = lineformatter.Escape(dst, key, lineformatter.KeySpecial)
+		dst = append(dst, '=')
+		dst = lineformatter.Escape(dst, tags[key], lineformatter.KeySpecial)
+	}
+	dst = append(dst, ' ')
+	dst = lineformatter.Escape(dst, field, lineformatter.KeySpecial)
+	dst = append(dst, '=')
+	dst = strconv.AppendFloat(dst, value, 'f', -1, 64)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, ts, 10)
+	return append(dst, '\n'), nil
+}
+
+// apply uses a template to extract the measurement, field and tags
+// from the parts of a Graphite path.
+func (t *graphiteTemplate) apply(parts []string, separator string) (string, string, map[string]string) {
+	var measurement, field []string
+	tagParts := make(map[string][]string)
+
+loop:
+	for i, element := range t.elements {
+		if i >= len(parts) {
+			break
+		}
+		switch element {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+			break loop
+		case "field":
+			field = append(field, parts[i])
+		case "field*":
+			field = append(field, parts[i:]...)
+			break loop
+		default:
+			tagParts[element] = append(tagParts[element], parts[i])
+		}
+	}
+
+	tags := make(map[string]string, len(t.tags)+len(tagParts))
+	for key, value := range t.tags {
+		tags[key] = value
+	}
+	for key, values := range tagParts {
+		// Tags from the path take priority over the template's tags
+		// but empty tag values aren't allowed.
+		if value := strings.Join(values, separator); value != "" {
+			tags[key] = value
+		}
+	}
+
+	fieldName := strings.Join(field, separator)
+	if fieldName == "" {
+		fieldName = graphiteDefaultField
+	}
+	return strings.Join(measurement, separator), fieldName, tags
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var graphiteNow = time.Unix(1500000000, 123)
+
+func TestGraphiteDefaultTemplate(t *testing.T) {
+	p, err := newGraphiteParser(nil, ".")
+	require.NoError(t, err)
+
+	assertGraphite(t, p, "servers.web01.cpu.load 0.5 1400000000\n",
+		"servers.web01.cpu.load value=0.5 1400000000000000000\n")
+	assertGraphite(t, p, "cpu 42",
+		"cpu value=42 1500000000000000123\n")
+	assertGraphite(t, p, "cpu 42 -1",
+		"cpu value=42 1500000000000000123\n")
+	assertGraphite(t, p, "cpu -1e3 1400000000.5",
+		"cpu value=-1000 1400000000500000000\n")
+}
+
+func TestGraphiteTemplates(t *testing.T) {
+	p, err := newGraphiteParser([]string{
+		"region.host.measurement* dc=1",
+		"servers.* .host.measurement*",
+		"servers.db*.disk .host.measurement.field*",
+		"stats.*.counters .host..measurement.field",
+		"app_* measurement.env.measurement.env",
+	}, "_")
+	require.NoError(t, err)
+
+	// The default template.
+	assertGraphite(t, p, "eu.web01.cpu.load 1 1",
+		"cpu_load,dc=1,host=web01,region=eu value=1 1000000000\n")
+
+	// Filtered templates, where the longest matching filter wins.
+	assertGraphite(t, p, "servers.web01.cpu.load 1 1",
+		"cpu_load,host=web01 value=1 1000000000\n")
+	assertGraphite(t, p, "servers.db01.disk.read.bytes 1 1",
+		"disk,host=db01 read_bytes=1 1000000000\n")
+	assertGraphite(t, p, "stats.web01.counters.requests.ok 1 1",
+		"requests,host=web01 ok=1 1000000000\n")
+
+	// Parts making up a tag are joined too.
+	assertGraphite(t, p, "app_foo.prod.requests.eu 1 1",
+		"app_foo_requests,env=prod_eu value=1 1000000000\n")
+
+	// Paths shorter than the template.
+	assertGraphite(t, p, "eu.web01 1 1",
+		"")
+	assertGraphite(t, p, "servers.web01.cpu 1 1",
+		"cpu,host=web01 value=1 1000000000\n")
+}
+
+func TestGraphiteTemplateTagPriority(t *testing.T) {
+	p, err := newGraphiteParser([]string{"host.measurement host=default,dc=1"}, ".")
+	require.NoError(t, err)
+
+	assertGraphite(t, p, "web01.cpu 1 1",
+		"cpu,dc=1,host=web01 value=1 1000000000\n")
+
+	// Empty path parts don't override the template's tags.
+	assertGraphite(t, p, ".cpu 1 1",
+		"cpu,dc=1,host=default value=1 1000000000\n")
+}
+
+func TestGraphiteEscaping(t *testing.T) {
+	p, err := newGraphiteParser([]string{"host.measurement.field"}, ".")
+	require.NoError(t, err)
+
+	assertGraphite(t, p, "a=b,c.cpu,x.f=g 1 1",
+		`cpu\,x,host=a\=b\,c f\=g=1 1000000000`+"\n")
+}
+
+func TestGraphiteConvertErrors(t *testing.T) {
+	p, err := newGraphiteParser(nil, ".")
+	require.NoError(t, err)
+
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"cpu", errGraphiteFormat},
+		{"cpu 1 2 3", errGraphiteFormat},
+		{"cpu x", errGraphiteValue},
+		{"cpu NaN", errGraphiteValue},
+		{"cpu +Inf", errGraphiteValue},
+		{"cpu 1 x", errGraphiteTimestamp},
+		{"cpu 1 -5", errGraphiteTimestamp},
+		{"cpu 1 1e20", errGraphiteTimestamp},
+	}
+	for _, test := range tests {
+		dst, err := p.Convert([]byte("keep\n"), []byte(test.line), graphiteNow)
+		assert.Equal(t, test.err, err, test.line)
+		assert.Equal(t, "keep\n", string(dst), test.line)
+	}
+}
+
+func TestGraphiteInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		templates []string
+		err       string
+	}{
+		{[]string{"host.cpu"}, `invalid graphite template "host.cpu": no measurement specified`},
+		{[]string{"measurement*.field*"}, `invalid graphite template "measurement*.field*": either measurement* or field* may be used, not both`},
+		{[]string{"a b c d"}, `invalid graphite template "a b c d": expected [filter] template [tags]`},
+		{[]string{"measurement x=1,y"}, `invalid graphite template "measurement x=1,y": invalid tag "y"`},
+		{[]string{"[ measurement"}, `invalid graphite template "[ measurement": invalid filter: syntax error in pattern`},
+		{[]string{"measurement", "measurement*"}, `invalid graphite template "measurement*": more than one template without a filter`},
+	}
+	for _, test := range tests {
+		_, err := newGraphiteParser(test.templates, ".")
+		assert.EqualError(t, err, test.err)
+	}
+}
+
+func assertGraphite(t *testing.T, p *graphiteParser, line, expected string) {
+	actual, err := p.Convert(nil, []byte(line), graphiteNow)
+	if expected == "" {
+		assert.Error(t, err, line)
+		return
+	}
+	require.NoError(t, err, line)
+	assert.Equal(t, expected, string(actual), line)
+}
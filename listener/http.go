@@ -0,0 +1,505 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// StartHTTPListener initialises listener configured to accept lines
+// from HTTP request bodies instead of via UDP. HTTPS is served instead
+// if a TLS certificate is configured. It starts the listener and its
+// statistician and never returns.
+func StartHTTPListener(c *config.Config) (*Listener, error) {
+	if t := c.ListenerDBSubjectTemplate; t != "" && !strings.Contains(t, dbPlaceholder) {
+		return nil, fmt.Errorf("listener_db_subject_template must contain %s", dbPlaceholder)
+	}
+
+	auth, err := newAuthenticator(c.ListenerAuthUsers, c.ListenerAuthFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %v", err)
+	}
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	listener.auth = auth
+	server := listener.setupHTTP()
+	server.TLSConfig = tlsConfig
+
+	listener.wg.Add(3)
+	go listener.startStatistician()
+	go listener.startBatchFlusher()
+	go listener.listenHTTP(server)
+
+	log.Printf("HTTP listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+// readBufPool holds buffers used to read HTTP request bodies before
+// they are appended to the batch buffer.
+var readBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, udpMaxDatagramSize)
+	},
+}
+
+// influxDBVersion is returned in the X-Influxdb-Version header of
+// all HTTP responses.
+const influxDBVersion = "influx-spout"
+
+func (l *Listener) setupHTTP() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", l.handleHTTPWrite)
+	mux.HandleFunc("/write/json", l.handleJSONWrite)
+	mux.HandleFunc("/api/v1/prom/write", l.handlePromWrite)
+	mux.HandleFunc("/ping", handleHTTPPing)
+	return &http.Server{
+		Addr: fmt.Sprintf(":%d", l.c.Port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Influxdb-Version", influxDBVersion)
+			mux.ServeHTTP(w, r)
+		}),
+	}
+}
+
+// handleHTTPPing responds to /ping requests in the same way as
+// InfluxDB does. This is typically used for health checks.
+func handleHTTPPing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHTTPWrite processes a /write request. Requests may be handled
+// concurrently so each request body is read into its own buffer. Only
+// complete lines are appended to the (shared) batch buffer so lines
+// from concurrent requests are never mixed up.
+//
+// If credentials are configured, requests must be authenticated (see
+// authenticator). Requests from sources which are over their rate
+// limit are rejected with a 429 response (see rateLimiter). Requests
+// are rejected with a 503 response while NATS is unavailable (see
+// natsAvailable).
+//
+// As for InfluxDB, malformed lines are dropped but the remaining lines
+// are accepted. A 400 response describing the first malformed line is
+// returned in this case.
+func (l *Listener) handleHTTPWrite(w http.ResponseWriter, r *http.Request) {
+	write, ok := l.startHTTPWrite(w, r)
+	if !ok {
+		return
+	}
+	params, batch, source := write.params, write.batch, write.source
+
+	body, err := decodeBody(r)
+	if err != nil {
+		l.stats.Inc(decompressErrors)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+	compressed := body != r.Body
+	if l.maxBodyBytes > 0 {
+		body = newLimitReader(body, l.maxBodyBytes)
+	}
+
+	buf := readBufPool.Get().([]byte)
+	defer readBufPool.Put(buf)
+
+	// Timestamps are converted to nanoseconds if a precision was
+	// given, either with the request or in the configuration.
+	precisionMult := params.precisionMult
+	if precisionMult == 0 {
+		precisionMult = l.precisionMult
+	}
+	received := time.Now()
+	var normalised []byte
+
+	var parseErr error
+	appendLines := func(lines []byte) {
+		var err error
+		if l.c.ListenerValidate {
+			lines, err = l.validateHTTPLines(lines)
+		} else {
+			lines, err = checkLines(lines)
+		}
+		if parseErr == nil {
+			parseErr = err
+		}
+		if precisionMult != 0 {
+			normalised, err = normaliseLines(normalised[:0], lines, precisionMult, received)
+			if parseErr == nil {
+				parseErr = err
+			}
+			lines = normalised
+		}
+		l.limiter.Take(source, countLines(lines))
+		l.appendBatch(batch, lines)
+	}
+
+	lr := newLineReader(buf)
+	for {
+		lines, err := lr.Read(body)
+
+		// Attempt to process the read even on error as Read may
+		// still have read some lines successfully.
+		appendLines(lines)
+
+		switch {
+		case err == nil:
+			continue
+		case err == io.EOF:
+			// The final line doesn't need to be newline terminated.
+			appendLines(lr.Remainder())
+			if parseErr != nil {
+				httpError(w, parseErr.Error(), http.StatusBadRequest)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case err == errLineTooLong:
+			l.stats.Inc(readErrors)
+			httpError(w, fmt.Sprintf("line longer than %d bytes", len(buf)),
+				http.StatusBadRequest)
+		case err == errBodyTooLarge:
+			l.stats.Inc(readErrors)
+			httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case compressed:
+			// Errors from a compressed body are most likely due to
+			// invalid compressed data.
+			l.stats.Inc(decompressErrors)
+			httpError(w, fmt.Sprintf("failed to decompress body: %v", err),
+				http.StatusBadRequest)
+		default:
+			l.stats.Inc(readErrors)
+			httpError(w, fmt.Sprintf("failed to read body: %v", err),
+				http.StatusBadRequest)
+		}
+		return
+	}
+}
+
+// httpWrite holds the details of a write request which has passed
+// the checks in startHTTPWrite.
+type httpWrite struct {
+	params *writeParams
+	batch  *batch      // lines are added to this batch
+	source *rateSource // the rate limit applying to the request
+}
+
+// startHTTPWrite performs the checks common to all write endpoints:
+// the request method, authentication, NATS availability, rate
+// limiting and the query parameters. If a check fails, an error
+// response is sent and false is returned.
+func (l *Listener) startHTTPWrite(w http.ResponseWriter, r *http.Request) (*httpWrite, bool) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var username string
+	if l.auth != nil {
+		var err error
+		username, err = l.auth.Authenticate(r)
+		if err != nil {
+			l.stats.Inc(authFailures)
+			if l.c.Debug {
+				log.Printf("HTTP write from %s: %v", r.RemoteAddr, err)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="influx-spout"`)
+			httpError(w, err.Error(), http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+
+	// Writes are refused while NATS can't accept them so that clients
+	// hold on to their data and retry later, rather than it being
+	// lost.
+	if !l.natsAvailable() {
+		l.stats.Inc(natsUnavailable)
+		if l.c.Debug {
+			log.Printf("HTTP write from %s: NATS unavailable", r.RemoteAddr)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(l.natsRetryAfter()))
+		httpError(w, "NATS unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	// Authenticated users with their own rate limit are limited by
+	// username. Otherwise requests are limited by remote address.
+	var source *rateSource
+	if l.limiter != nil {
+		source = l.limiter.UserSource(username)
+		if source == nil {
+			source = l.limiter.IPSource(remoteIP(r))
+		}
+		if !l.limiter.Allow(source, 0) {
+			if l.c.Debug {
+				log.Printf("HTTP write from %s: rate limit exceeded", r.RemoteAddr)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(l.limiter.RetryAfter(source)))
+			httpError(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return nil, false
+		}
+	}
+
+	params, err := parseWriteParams(r.URL.Query())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	subject, err := l.dbSubject(params.db)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if l.c.Debug {
+		log.Printf("HTTP write to %s: db=%q rp=%q precision=%q subject=%q",
+			r.URL.Path, params.db, params.rp, params.precision, subject)
+	}
+
+	return &httpWrite{
+		params: params,
+		batch:  l.dbBatch(subject),
+		source: source,
+	}, true
+}
+
+// httpError sends an error response with a JSON body in the same
+// format as InfluxDB.
+func httpError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// writeParams holds the query parameters of a /write request.
+type writeParams struct {
+	db string
+
+	// rp is accepted for compatibility with InfluxDB but is only
+	// logged. Lines can't carry a retention policy so points are
+	// written to the retention policy used by the writer (normally
+	// the database's default).
+	rp string
+
+	precision string
+
+	// precisionMult converts timestamps to nanoseconds. It is 0 if
+	// no precision was given.
+	precisionMult int64
+}
+
+func parseWriteParams(query url.Values) (*writeParams, error) {
+	params := &writeParams{
+		db:        query.Get("db"),
+		rp:        query.Get("rp"),
+		precision: query.Get("precision"),
+	}
+	if params.precision != "" {
+		mult, err := precisionToMultiplier(params.precision)
+		if err != nil {
+			return nil, err
+		}
+		params.precisionMult = mult
+	}
+	return params, nil
+}
+
+// dbPlaceholder is replaced with the database name in
+// listener_db_subject_template.
+const dbPlaceholder = "{db}"
+
+// dbSubject returns the NATS subject which lines written to the
+// database db should be published to. Databases listed in
+// listener_db_subjects take priority over listener_db_subject_template.
+// The default subject is used if neither apply.
+func (l *Listener) dbSubject(db string) (string, error) {
+	if db == "" {
+		return l.c.NATSSubject[0], nil
+	}
+	if subject, ok := l.c.ListenerDBSubjects[db]; ok {
+		return subject, nil
+	}
+	if l.c.ListenerDBSubjectTemplate == "" {
+		return l.c.NATSSubject[0], nil
+	}
+	if !isValidSubjectToken(db) {
+		return "", fmt.Errorf("database name %q can't be used in a NATS subject", db)
+	}
+	return strings.Replace(l.c.ListenerDBSubjectTemplate, dbPlaceholder, db, -1), nil
+}
+
+// isValidSubjectToken returns true if s may be used as a single
+// token (the part between dots) of a NATS subject.
+func isValidSubjectToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+func (l *Listener) listenHTTP(server *http.Server) {
+	defer l.wg.Done()
+
+	go func() {
+		l.setReady()
+		var err error
+		if server.TLSConfig != nil {
+			// The certificate is already in the TLS config.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err == nil || err == http.ErrServerClosed {
+			return
+		}
+		log.Fatal(err)
+	}()
+
+	// Close the server if the stop channel is closed.
+	<-l.stop
+	server.Close()
+}
+
+// newTLSConfig returns the TLS configuration for the HTTP listener,
+// or nil if TLS isn't enabled. If a client CA is configured, clients
+// must present a certificate signed by it.
+func newTLSConfig(c *config.Config) (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" {
+			return nil, errors.New("tls_client_ca_file requires tls_cert_file and tls_key_file")
+		}
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if c.TLSClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// decodeBody returns a reader for the request body which undoes any
+// compression indicated by the Content-Encoding header.
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		return zr, nil
+	case "deflate":
+		// HTTP's "deflate" encoding is actually zlib (RFC 1950).
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate body: %v", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %q", encoding)
+	}
+}
+
+func newLimitReader(r io.ReadCloser, limit int64) *limitReader {
+	return &limitReader{ReadCloser: r, remaining: limit}
+}
+
+// limitReader wraps an io.ReadCloser, returning errBodyTooLarge if
+// more than a fixed number of bytes are read from it. Unlike
+// io.LimitReader, the caller can tell the difference between hitting
+// the limit and reaching the end of the data.
+type limitReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one more byte than allowed so that going over the limit
+	// can be detected.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n + int(r.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// remoteIP returns the IP address of the client which made a request.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
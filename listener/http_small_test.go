@@ -0,0 +1,63 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitReaderUnderLimit(t *testing.T) {
+	r := newLimitReader(ioutil.NopCloser(strings.NewReader("hello")), 5)
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestLimitReaderOverLimit(t *testing.T) {
+	r := newLimitReader(ioutil.NopCloser(strings.NewReader("hello world")), 5)
+
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	assert.Equal(t, errBodyTooLarge, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	n, err = r.Read(buf)
+	assert.Equal(t, errBodyTooLarge, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLimitReaderSmallReads(t *testing.T) {
+	r := newLimitReader(ioutil.NopCloser(strings.NewReader("hello world")), 5)
+
+	buf := make([]byte, 3)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hel", string(buf[:n]))
+
+	n, err = r.Read(buf)
+	assert.Equal(t, errBodyTooLarge, err)
+	assert.Equal(t, "lo", string(buf[:n]))
+
+	_, err = io.ReadFull(r, buf)
+	assert.Equal(t, errBodyTooLarge, err)
+}
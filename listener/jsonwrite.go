@@ -0,0 +1,297 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+var (
+	errJSONMeasurement = errors.New("missing measurement")
+	errJSONNoFields    = errors.New("no fields")
+	errJSONNewline     = errors.New("newlines are not allowed")
+	errJSONTime        = errors.New("invalid time")
+)
+
+// jsonPoint is a point sent to the /write/json endpoint.
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        interface{}            `json:"time"`
+}
+
+// jsonPointError describes a point which couldn't be converted.
+type jsonPointError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// handleJSONWrite processes a /write/json request. The body holds
+// either an array of points or newline delimited points in JSON (see
+// jsonPoint). Each point is converted to a line and added to the
+// batch.
+//
+// As for /write, points which can't be converted are dropped but the
+// remaining points are accepted. A 400 response listing the error for
+// each invalid point is returned in this case. If the body isn't
+// valid JSON, the whole request is rejected.
+func (l *Listener) handleJSONWrite(w http.ResponseWriter, r *http.Request) {
+	write, ok := l.startHTTPWrite(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		l.stats.Inc(decompressErrors)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+	if l.maxBodyBytes > 0 {
+		body = newLimitReader(body, l.maxBodyBytes)
+	}
+
+	points, err := decodeJSONPoints(body)
+	if err == errBodyTooLarge {
+		l.stats.Inc(readErrors)
+		httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		l.stats.Inc(readErrors)
+		httpError(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Timestamps are converted to nanoseconds if a precision was
+	// given, either with the request or in the configuration.
+	precisionMult := write.params.precisionMult
+	if precisionMult == 0 {
+		precisionMult = l.precisionMult
+	}
+	received := time.Now()
+
+	var lines []byte
+	var pointErrs []jsonPointError
+	for i, raw := range points {
+		lines, err = appendJSONPoint(lines, raw, precisionMult, received)
+		if err != nil {
+			l.stats.Inc(linesRejected)
+			pointErrs = append(pointErrs, jsonPointError{Index: i, Error: err.Error()})
+		}
+	}
+
+	if l.c.ListenerValidate {
+		lines = l.validateLines(lines)
+	}
+	l.limiter.Take(write.source, countLines(lines))
+	l.appendBatch(write.batch, lines)
+
+	if len(pointErrs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Error  string           `json:"error"`
+			Errors []jsonPointError `json:"errors"`
+		}{
+			Error:  fmt.Sprintf("%d of %d points could not be converted", len(pointErrs), len(points)),
+			Errors: pointErrs,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeJSONPoints splits a request body into the raw JSON for each
+// point. The body is either a JSON array or a sequence of JSON values
+// (typically one per line). The points themselves are decoded
+// separately so that an invalid point only affects itself.
+func decodeJSONPoints(r io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	var points []json.RawMessage
+
+	first, err := firstNonSpace(br)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if first == '[' {
+		if err := dec.Decode(&points); err != nil {
+			return nil, err
+		}
+		// Nothing may follow the array.
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("unexpected data after array")
+		}
+		return points, nil
+	}
+
+	for {
+		var point json.RawMessage
+		err := dec.Decode(&point)
+		if err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+}
+
+// firstNonSpace returns the first byte in r which isn't whitespace,
+// without consuming it.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// appendJSONPoint converts a point to a line, appending it to dst.
+// dst is returned unchanged if the point can't be converted.
+//
+// Numeric times are converted to nanoseconds using mult, if it isn't
+// 0. Times may also be RFC3339 strings. Points without a time are
+// given the time now if mult isn't 0 (like lines sent to /write).
+func appendJSONPoint(dst []byte, raw json.RawMessage, mult int64, now time.Time) ([]byte, error) {
+	var p jsonPoint
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&p); err != nil {
+		return dst, err
+	}
+	if p.Measurement == "" {
+		return dst, errJSONMeasurement
+	}
+	if len(p.Fields) == 0 {
+		return dst, errJSONNoFields
+	}
+	if hasNewline(p.Measurement) {
+		return dst, errJSONNewline
+	}
+
+	tagKeys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+	tagVals := make([]string, len(tagKeys))
+	for i, k := range tagKeys {
+		v := p.Tags[k]
+		if k == "" || v == "" {
+			return dst, fmt.Errorf("invalid tag %q", k)
+		}
+		if hasNewline(k) || hasNewline(v) {
+			return dst, errJSONNewline
+		}
+		tagVals[i] = v
+	}
+
+	fieldKeys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	fieldVals := make([]interface{}, len(fieldKeys))
+	for i, k := range fieldKeys {
+		if k == "" || hasNewline(k) {
+			return dst, fmt.Errorf("invalid field %q", k)
+		}
+		v, err := jsonFieldValue(p.Fields[k])
+		if err != nil {
+			return dst, fmt.Errorf("invalid value for field %q", k)
+		}
+		fieldVals[i] = v
+	}
+
+	f := lineformatter.New(p.Measurement, tagKeys, fieldKeys...)
+	switch t := p.Time.(type) {
+	case nil:
+		if mult == 0 {
+			return append(dst, f.Format(tagVals, fieldVals...)...), nil
+		}
+		return append(dst, f.FormatT(now, tagVals, fieldVals...)...), nil
+	case json.Number:
+		ts, err := t.Int64()
+		if err != nil {
+			return dst, errJSONTime
+		}
+		if mult == 0 {
+			mult = 1
+		}
+		if ts > math.MaxInt64/mult || ts < math.MinInt64/mult {
+			return dst, errTimestampRange
+		}
+		return append(dst, f.FormatT(time.Unix(0, ts*mult), tagVals, fieldVals...)...), nil
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return dst, errJSONTime
+		}
+		return append(dst, f.FormatT(ts, tagVals, fieldVals...)...), nil
+	default:
+		return dst, errJSONTime
+	}
+}
+
+// jsonFieldValue returns the value to pass to a LineFormatter for a
+// JSON field value. Numbers are stored as floats, as for InfluxDB's
+// (deprecated) JSON write API.
+func jsonFieldValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil || math.IsInf(f, 0) {
+			return nil, errInvalidFieldValue
+		}
+		return f, nil
+	case string:
+		if hasNewline(v) {
+			return nil, errJSONNewline
+		}
+		return v, nil
+	case bool:
+		return v, nil
+	default:
+		return nil, errInvalidFieldValue
+	}
+}
+
+func hasNewline(s string) bool {
+	return strings.IndexByte(s, '\n') != -1
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var jsonNow = time.Unix(1500000000, 123)
+
+func TestAppendJSONPoint(t *testing.T) {
+	tests := []struct {
+		point    string
+		mult     int64
+		expected string
+	}{
+		{
+			`{"measurement": "cpu", "tags": {"host": "web01", "dc": "eu"}, "fields": {"load": 0.5, "idle": 90}, "time": 1500000000000000000}`,
+			0,
+			"cpu,dc=eu,host=web01 idle=90,load=0.5 1500000000000000000\n",
+		},
+		{
+			`{"measurement": "app", "fields": {"ok": true, "msg": "say \"hi\""}}`,
+			0,
+			`app msg="say \"hi\"",ok=t` + "\n",
+		},
+		{
+			`{"measurement": "app", "fields": {"x": 1}}`,
+			1,
+			"app x=1 1500000000000000123\n",
+		},
+		{
+			`{"measurement": "app", "fields": {"x": 1}, "time": 1500000000}`,
+			int64(time.Second),
+			"app x=1 1500000000000000000\n",
+		},
+		{
+			`{"measurement": "app", "fields": {"x": 1}, "time": "2017-07-14T02:40:00.5Z"}`,
+			int64(time.Second),
+			"app x=1 1500000000500000000\n",
+		},
+		{
+			`{"measurement": "my app,x", "tags": {"a=b": "c d,e"}, "fields": {"f g": 1}}`,
+			0,
+			`my\ app\,x,a\=b=c\ d\,e f\ g=1` + "\n",
+		},
+	}
+	for _, test := range tests {
+		actual, err := appendJSONPoint(nil, json.RawMessage(test.point), test.mult, jsonNow)
+		require.NoError(t, err, test.point)
+		assert.Equal(t, test.expected, string(actual), test.point)
+	}
+}
+
+func TestAppendJSONPointErrors(t *testing.T) {
+	tests := []struct {
+		point string
+		err   string
+	}{
+		{`{"fields": {"x": 1}}`, "missing measurement"},
+		{`{"measurement": "m"}`, "no fields"},
+		{`{"measurement": "m", "fields": {}}`, "no fields"},
+		{`{"measurement": "m\n", "fields": {"x": 1}}`, "newlines are not allowed"},
+		{`{"measurement": "m", "tags": {"t": ""}, "fields": {"x": 1}}`, `invalid tag "t"`},
+		{`{"measurement": "m", "tags": {"t": "a\nb"}, "fields": {"x": 1}}`, "newlines are not allowed"},
+		{`{"measurement": "m", "fields": {"": 1}}`, `invalid field ""`},
+		{`{"measurement": "m", "fields": {"x": null}}`, `invalid value for field "x"`},
+		{`{"measurement": "m", "fields": {"x": [1]}}`, `invalid value for field "x"`},
+		{`{"measurement": "m", "fields": {"x": 1e999}}`, `invalid value for field "x"`},
+		{`{"measurement": "m", "fields": {"x": "a\nb"}}`, `invalid value for field "x"`},
+		{`{"measurement": "m", "fields": {"x": 1}, "time": 1.5}`, "invalid time"},
+		{`{"measurement": "m", "fields": {"x": 1}, "time": "yesterday"}`, "invalid time"},
+		{`{"measurement": "m", "fields": {"x": 1}, "time": true}`, "invalid time"},
+	}
+	for _, test := range tests {
+		dst, err := appendJSONPoint([]byte("keep\n"), json.RawMessage(test.point), 0, jsonNow)
+		assert.EqualError(t, err, test.err, test.point)
+		assert.Equal(t, "keep\n", string(dst), test.point)
+	}
+
+	_, err := appendJSONPoint(nil, json.RawMessage(`{"measurement": "m", "fields": {"x": 1}, "time": 9999999999999}`),
+		int64(time.Second), jsonNow)
+	assert.Equal(t, errTimestampRange, err)
+
+	// Type errors are reported too.
+	_, err = appendJSONPoint(nil, json.RawMessage(`{"measurement": "m", "tags": {"t": 1}, "fields": {"x": 1}}`), 0, jsonNow)
+	assert.Error(t, err)
+	_, err = appendJSONPoint(nil, json.RawMessage(`"m x=1"`), 0, jsonNow)
+	assert.Error(t, err)
+}
+
+func TestDecodeJSONPoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"empty", "", nil},
+		{"array", ` [{"a": 1}, {"b": 2}] `, []string{`{"a": 1}`, `{"b": 2}`}},
+		{"empty array", `[]`, []string{}},
+		{"newline delimited", "{\"a\": 1}\n{\"b\": 2}\n", []string{`{"a": 1}`, `{"b": 2}`}},
+		{"single", `{"a": 1}`, []string{`{"a": 1}`}},
+	}
+	for _, test := range tests {
+		points, err := decodeJSONPoints(bytes.NewBufferString(test.body))
+		require.NoError(t, err, test.name)
+		var actual []string
+		if points != nil {
+			actual = []string{}
+		}
+		for _, point := range points {
+			actual = append(actual, string(point))
+		}
+		assert.Equal(t, test.expected, actual, test.name)
+	}
+}
+
+func TestDecodeJSONPointsErrors(t *testing.T) {
+	for _, body := range []string{
+		`[{"a": 1}`,
+		`[{"a": 1}] {"b": 2}`,
+		"{\"a\": 1}\n{\"b\": ",
+		"{\"a\": 1}\nfoo x=1",
+	} {
+		_, err := decodeJSONPoints(bytes.NewBufferString(body))
+		assert.Error(t, err, body)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+func newLineReader(buf []byte) *lineReader {
+	return &lineReader{buf: buf}
+}
+
+// lineReader reads from an io.Reader into a fixed size buffer,
+// returning only complete lines. A partial line at the end of a read
+// is held until the rest of it arrives.
+type lineReader struct {
+	buf   []byte
+	start int // start of the partial line (if any)
+	end   int // end of the data in buf
+}
+
+// Read performs a single read from r and returns any complete lines
+// which are now available. The returned slice is only valid until the
+// next call to Read.
+//
+// errLineTooLong is returned if the buffer fills up without a line
+// being completed. Other errors are passed through from r.
+func (lr *lineReader) Read(r io.Reader) ([]byte, error) {
+	// Move any partial line left from the last read to the start of
+	// the buffer.
+	if lr.start > 0 {
+		lr.end = copy(lr.buf, lr.buf[lr.start:lr.end])
+		lr.start = 0
+	}
+
+	n, err := r.Read(lr.buf[lr.end:])
+	lr.end += n
+
+	i := bytes.LastIndexByte(lr.buf[:lr.end], '\n')
+	if i == -1 {
+		if lr.end == len(lr.buf) {
+			return nil, errLineTooLong
+		}
+		return nil, err
+	}
+	lr.start = i + 1
+	return lr.buf[:lr.start], err
+}
+
+// Remainder returns any partial line held by the lineReader, with a
+// newline appended. This is useful once the input has been exhausted
+// as the final line doesn't need to be newline terminated. nil is
+// returned if there is no partial line.
+func (lr *lineReader) Remainder() []byte {
+	if lr.start == lr.end {
+		return nil
+	}
+	line := append(lr.buf[lr.start:lr.end], '\n')
+	lr.start, lr.end = 0, 0
+	return line
+}
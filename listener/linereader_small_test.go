@@ -0,0 +1,92 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineReader(t *testing.T) {
+	const input = "foo x=1\nbar x=2\nbazzz x=3\nqux"
+
+	// Try all read sizes up to the length of the input.
+	for size := 1; size <= len(input); size++ {
+		r := &chunkReader{s: input, size: size}
+		lr := newLineReader(make([]byte, 64))
+
+		var out []string
+		for {
+			lines, err := lr.Read(r)
+			if len(lines) > 0 {
+				assert.True(t, strings.HasSuffix(string(lines), "\n"))
+				out = append(out, string(lines))
+			}
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "qux\n", string(lr.Remainder()))
+		assert.Nil(t, lr.Remainder())
+		assert.Equal(t, input[:len(input)-3], strings.Join(out, ""), "size=%d", size)
+	}
+}
+
+func TestLineReaderTooLong(t *testing.T) {
+	lr := newLineReader(make([]byte, 8))
+
+	lines, err := lr.Read(strings.NewReader("foo\nbar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo\n", string(lines))
+
+	// The partial line is moved to the start of the buffer but the
+	// line still doesn't fit.
+	lines, err = lr.Read(strings.NewReader("ab"))
+	assert.NoError(t, err)
+	assert.Nil(t, lines)
+
+	lines, err = lr.Read(strings.NewReader("cdefgh"))
+	assert.Equal(t, errLineTooLong, err)
+	assert.Nil(t, lines)
+}
+
+// chunkReader returns the contents of a string in chunks of a fixed
+// size.
+type chunkReader struct {
+	s    string
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.s) == 0 {
+		return 0, io.EOF
+	}
+	n := r.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.s) {
+		n = len(r.s)
+	}
+	copy(p, r.s[:n])
+	r.s = r.s[n:]
+	return n, nil
+}
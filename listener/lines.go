@@ -0,0 +1,257 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// checkLines removes blank lines, comments and malformed lines from
+// a block of newline terminated lines. The remaining lines are
+// returned, along with an error describing the first malformed line
+// (if any). The lines are filtered in place.
+func checkLines(lines []byte) ([]byte, error) {
+	var firstErr error
+	out := filterLines(lines, checkLine, func(line []byte, err error) {
+		if firstErr == nil {
+			firstErr = parseError(line, err)
+		}
+	})
+	return out, firstErr
+}
+
+// filterLines removes blank lines, comments and lines which fail
+// check from a block of lines, calling reject (if not nil) for each
+// line which fails. The final line doesn't need to be newline
+// terminated. The lines are filtered in place and the remaining
+// lines are returned.
+func filterLines(lines []byte, check func([]byte) error, reject func([]byte, error)) []byte {
+	out := lines[:0]
+	keepAll := true
+	for remaining := lines; len(remaining) > 0; {
+		var line []byte
+		if i := bytes.IndexByte(remaining, '\n'); i == -1 {
+			line, remaining = remaining, nil
+		} else {
+			line, remaining = remaining[:i+1], remaining[i+1:]
+		}
+
+		keep := true
+		if isBlankOrComment(line) {
+			keep = false
+		} else if err := check(line); err != nil {
+			if reject != nil {
+				reject(line, err)
+			}
+			keep = false
+		}
+
+		// Lines only need to be moved once a line has been dropped.
+		if !keep {
+			keepAll = false
+		} else if keepAll {
+			out = out[:len(out)+len(line)]
+		} else {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// parseError describes a line which couldn't be parsed.
+func parseError(line []byte, err error) error {
+	return fmt.Errorf("unable to parse '%s': %v", bytes.TrimSpace(line), err)
+}
+
+func isBlankOrComment(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || line[0] == '#'
+}
+
+var (
+	errMissingMeasurement = errors.New("missing measurement")
+	errMissingFields      = errors.New("missing fields")
+)
+
+// checkLine performs basic sanity checks on a line, ensuring that it
+// has a measurement and fields.
+func checkLine(line []byte) error {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 || line[0] == ',' || line[0] == ' ' {
+		return errMissingMeasurement
+	}
+	i := unescapedIndexByte(line, ' ')
+	if i == -1 || len(bytes.TrimSpace(line[i:])) == 0 {
+		return errMissingFields
+	}
+	return nil
+}
+
+// unescapedIndexByte returns the index of the first instance of c in
+// s which isn't escaped with a backslash, or -1 if there isn't one.
+func unescapedIndexByte(s []byte, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// precisionMultipliers maps the supported timestamp precisions to
+// the value required to convert timestamps of that precision to
+// nanoseconds.
+var precisionMultipliers = map[string]int64{
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+func precisionToMultiplier(precision string) (int64, error) {
+	mult, ok := precisionMultipliers[precision]
+	if !ok {
+		return 0, fmt.Errorf("invalid precision %q (use n, u, ms, s, m or h)", precision)
+	}
+	return mult, nil
+}
+
+var (
+	errInvalidTimestamp = errors.New("invalid timestamp")
+	errTimestampRange   = errors.New("timestamp out of range")
+)
+
+// normaliseLines appends lines to dst, converting the timestamp of
+// each line to nanoseconds using mult (see precisionMultipliers).
+// Lines without a timestamp are given the timestamp now. The final
+// line doesn't need to be newline terminated.
+//
+// Blank lines and comments are dropped, as are lines with invalid
+// timestamps. The error for the first invalid line (if any) is
+// returned.
+func normaliseLines(dst, lines []byte, mult int64, now time.Time) ([]byte, error) {
+	var firstErr error
+	for len(lines) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(lines, '\n'); i == -1 {
+			line, lines = lines, nil
+		} else {
+			line, lines = lines[:i+1], lines[i+1:]
+		}
+		if isBlankOrComment(line) {
+			continue
+		}
+
+		var err error
+		dst, err = normaliseLine(dst, line, mult, now)
+		if err != nil && firstErr == nil {
+			firstErr = parseError(line, err)
+		}
+	}
+	return dst, firstErr
+}
+
+func normaliseLine(dst, line []byte, mult int64, now time.Time) ([]byte, error) {
+	line = bytes.TrimRight(line, " \r\n")
+
+	i := timestampIndex(line)
+	if i == -1 {
+		dst = append(dst, line...)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, now.UnixNano(), 10)
+		return append(dst, '\n'), nil
+	}
+
+	ts, err := parseInt(line[i:])
+	if err != nil {
+		return dst, err
+	}
+	if ts > math.MaxInt64/mult || ts < math.MinInt64/mult {
+		return dst, errTimestampRange
+	}
+	dst = append(dst, line[:i]...)
+	dst = strconv.AppendInt(dst, ts*mult, 10)
+	return append(dst, '\n'), nil
+}
+
+// timestampIndex returns the index of the start of the timestamp in
+// line, or -1 if the line has no timestamp. line must not have
+// trailing whitespace.
+func timestampIndex(line []byte) int {
+	// Skip over the measurement and tags.
+	i := unescapedIndexByte(line, ' ')
+	if i == -1 {
+		return -1
+	}
+
+	// Find the end of the fields, taking care with string field
+	// values which may contain spaces.
+	inString := false
+	for i++; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			inString = !inString
+		case ' ':
+			if !inString {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// parseInt converts a base 10 integer in a byte slice to an int64. It
+// avoids the allocation that strconv.ParseInt would require.
+func parseInt(s []byte) (int64, error) {
+	neg := false
+	if len(s) > 0 && s[0] == '-' {
+		neg = true
+		s = s[1:]
+	}
+	if len(s) == 0 || len(s) > 19 {
+		return 0, errInvalidTimestamp
+	}
+
+	var n uint64
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, errInvalidTimestamp
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	if neg {
+		if n > -math.MinInt64 {
+			return 0, errTimestampRange
+		}
+		return -int64(n), nil
+	}
+	if n > math.MaxInt64 {
+		return 0, errTimestampRange
+	}
+	return int64(n), nil
+}
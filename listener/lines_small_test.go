@@ -0,0 +1,122 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLine(t *testing.T) {
+	check := func(line string, expected error) {
+		assert.Equal(t, expected, checkLine([]byte(line)), "checkLine(%q)", line)
+	}
+
+	check("foo x=1\n", nil)
+	check("foo x=1", nil)
+	check("foo,host=a x=1 1234\n", nil)
+	check(`foo\ bar,host=a\ b x=1`+"\n", nil)
+
+	check("\n", errMissingMeasurement)
+	check(" x=1\n", errMissingMeasurement)
+	check(",host=a x=1\n", errMissingMeasurement)
+	check("foo\n", errMissingFields)
+	check("foo,host=a\n", errMissingFields)
+	check("foo \n", errMissingFields)
+	check(`foo\ x=1`+"\n", errMissingFields)
+}
+
+func TestCheckLinesAllValid(t *testing.T) {
+	lines := []byte("foo x=1\nbar y=2\n")
+	out, err := checkLines(lines)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo x=1\nbar y=2\n", string(out))
+}
+
+func TestCheckLinesDropsInvalid(t *testing.T) {
+	lines := []byte("foo x=1\nbad\n\n# comment\nbar y=2\n,x y=1\nqux z=3\n")
+	out, err := checkLines(lines)
+	assert.EqualError(t, err, "unable to parse 'bad': missing fields")
+	assert.Equal(t, "foo x=1\nbar y=2\nqux z=3\n", string(out))
+}
+
+func TestCheckLinesEmpty(t *testing.T) {
+	out, err := checkLines(nil)
+	assert.NoError(t, err)
+	assert.Len(t, out, 0)
+}
+
+func TestNormaliseLines(t *testing.T) {
+	now := time.Unix(0, 1234)
+	check := func(input string, mult int64, expected string) {
+		out, err := normaliseLines(nil, []byte(input), mult, now)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(out), "normaliseLines(%q, %d)", input, mult)
+	}
+
+	check("foo x=1 1\n", 1, "foo x=1 1\n")
+	check("foo x=1 15\n", 1000, "foo x=1 15000\n")
+	check("foo x=1 15", 1000, "foo x=1 15000\n")
+	check("foo x=1 15 \r\n", 1000, "foo x=1 15000\n")
+	check("foo x=1 -15\n", 1000, "foo x=1 -15000\n")
+	check("foo x=1 15\nbar y=2 16\n", 1000, "foo x=1 15000\nbar y=2 16000\n")
+	check("foo,host=a\\ b x=1,y=2 15\n", 1000, "foo,host=a\\ b x=1,y=2 15000\n")
+	check(`foo s="a b",t="c\" d" 15`, 1000, `foo s="a b",t="c\" d" 15000`+"\n")
+
+	// No timestamp
+	check("foo x=1\n", 1000, "foo x=1 1234\n")
+	check("foo x=1", 1000, "foo x=1 1234\n")
+	check(`foo s="a b"`, 1000, `foo s="a b" 1234`+"\n")
+
+	// Blank lines & comments are dropped.
+	check("\n# comment\nfoo x=1 1\n\n", 1, "foo x=1 1\n")
+}
+
+func TestNormaliseLinesErrors(t *testing.T) {
+	now := time.Unix(0, 1234)
+	check := func(input string, mult int64, expectedErr string) {
+		out, err := normaliseLines(nil, []byte(input+"\nok x=1 1\n"), mult, now)
+		assert.EqualError(t, err, expectedErr)
+		assert.Equal(t, "ok x=1 "+strconv.FormatInt(mult, 10)+"\n", string(out))
+	}
+
+	check("foo x=1 abc", 1, "unable to parse 'foo x=1 abc': invalid timestamp")
+	check("foo x=1 1 2", 1, "unable to parse 'foo x=1 1 2': invalid timestamp")
+	check("foo x=1 -", 1, "unable to parse 'foo x=1 -': invalid timestamp")
+	check("foo x=1 99999999999999999999", 1, "unable to parse 'foo x=1 99999999999999999999': invalid timestamp")
+	check("foo x=1 9223372036854775808", 1, "unable to parse 'foo x=1 9223372036854775808': timestamp out of range")
+	check("foo x=1 9223372036854775", 1e6, "unable to parse 'foo x=1 9223372036854775': timestamp out of range")
+}
+
+func TestParseInt(t *testing.T) {
+	check := func(input string, expected int64) {
+		n, err := parseInt([]byte(input))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n, "parseInt(%q)", input)
+	}
+
+	check("0", 0)
+	check("1", 1)
+	check("-1", -1)
+	check("1234567890", 1234567890)
+	check("9223372036854775807", math.MaxInt64)
+	check("-9223372036854775808", math.MinInt64)
+}
@@ -17,13 +17,13 @@
 package listener
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/go-nats"
@@ -35,23 +35,46 @@ import (
 
 const (
 	// Listener stats counters
-	linesReceived = "lines-received"
-	batchesSent   = "batches-sent"
-	readErrors    = "read-errors"
+	linesReceived    = "lines-received"
+	batchesSent      = "batches-sent"
+	readErrors       = "read-errors"
+	decompressErrors = "decompress-errors"
+	authFailures     = "auth-failures"
+	linesAccepted    = "lines-accepted"
+	linesRejected    = "lines-rejected"
+	natsUnavailable  = "nats-unavailable"
 
 	// The maximum possible UDP read size.
 	udpMaxDatagramSize = 65536
 )
 
-var allStats = []string{linesReceived, batchesSent, readErrors}
+var allStats = []string{
+	linesReceived,
+	batchesSent,
+	readErrors,
+	decompressErrors,
+	authFailures,
+	linesAccepted,
+	linesRejected,
+	natsUnavailable,
+}
 
 var statsInterval = 3 * time.Second
 
+// dbBatchIdleTimeout is how long the batch for a database's NATS
+// subject is kept once it has been sent and no more lines have been
+// written to it.
+var dbBatchIdleTimeout = time.Minute
+
 // StartListener initialises a listener, starts its statistician
 // goroutine and runs it's main loop. It never returns.
 //
 // The listener reads incoming UDP packets, batches them up and send
 // batches onwards to a NATS subject.
+//
+// If more than one UDP socket is configured, the sockets share the
+// port using SO_REUSEPORT and each has its own read loop and batch
+// (see startUDPSockets).
 func StartListener(c *config.Config) (_ *Listener, err error) {
 	listener, err := newListener(c)
 	if err != nil {
@@ -63,53 +86,87 @@ func StartListener(c *config.Config) (_ *Listener, err error) {
 		}
 	}()
 
-	sc, err := listener.setupUDP(c.ReadBufferBytes)
-	if err != nil {
-		return nil, err
+	if c.ListenerUDPSockets > 1 {
+		if err := listener.startUDPSockets(c.ListenerUDPSockets); err != nil {
+			return nil, err
+		}
+		log.Printf("UDP listener (%d sockets) publishing to [%s] at %s",
+			c.ListenerUDPSockets, c.NATSSubject[0], c.NATSAddress)
+		listener.notifyState("ready")
+		return listener, nil
 	}
 
-	listener.wg.Add(2)
-	go listener.startStatistician()
-	go listener.listenUDP(sc)
-
-	log.Printf("UDP listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
-	listener.notifyState("ready")
-
-	return listener, nil
-}
-
-// StartHTTPListener initialises listener configured to accept lines
-// from HTTP request bodies instead of via UDP. It starts the listener
-// and its statistician and never returns.
-func StartHTTPListener(c *config.Config) (*Listener, error) {
-	listener, err := newListener(c)
+	sc, err := listener.setupUDP(c.ReadBufferBytes)
 	if err != nil {
 		return nil, err
 	}
-	server := listener.setupHTTP()
 
 	listener.wg.Add(2)
 	go listener.startStatistician()
-	go listener.listenHTTP(server)
+	go listener.listenDatagrams(sc)
 
-	log.Printf("HTTP listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	log.Printf("UDP listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
 	listener.notifyState("ready")
 
 	return listener, nil
 }
 
 type Listener struct {
+	// Bytes published while the NATS connection is being
+	// re-established. The NATS client buffers these until it
+	// reconnects, up to natsBufferLimit bytes. Accessed atomically so
+	// it is kept first for 64-bit alignment.
+	natsBuffered    int64
+	natsBufferLimit int64
+
 	c     *config.Config
 	nc    *nats.Conn
 	stats *stats.Stats
 
-	buf                []byte
-	batchSize          int
+	// Each batch has its own lock (see appendBatch). mu protects
+	// dbBatches and templatedBatches.
+	mu                 sync.Mutex
+	batch              *batch            // for the default NATS subject
+	dbBatches          map[string]*batch // keyed by NATS subject
+	templatedBatches   int               // dbBatches created from the subject template
 	batchSizeThreshold int
-
-	wg    sync.WaitGroup
-	ready chan struct{} // Is close once the listener is listening
-	stop  chan struct{}
+	batchMaxAge        time.Duration
+
+	// Maximum (decompressed) HTTP request body size.
+	maxBodyBytes int64
+
+	// Converts timestamps in received lines to nanoseconds. 0 if
+	// timestamps should be left alone.
+	precisionMult int64
+
+	// Checks the credentials of HTTP requests. nil if authentication
+	// isn't required.
+	auth *authenticator
+
+	// Applies per-source rate limits to the UDP and HTTP listeners.
+	// nil if no rate limits are configured.
+	limiter *rateLimiter
+
+	// Open connections (only used by the TCP and Unix stream
+	// listeners).
+	connsMu     sync.Mutex
+	conns       map[*streamConn]struct{}
+	unixConnSeq uint64
+
+	// Converts Graphite plaintext lines to line protocol. Only used
+	// by the Graphite listener.
+	graphite *graphiteParser
+
+	// Set for the OpenTSDB listener, which converts put commands to
+	// line protocol. HTTP connections accepted by that listener are
+	// handed over to httpConns.
+	openTSDB  bool
+	httpConns *connListener
+
+	wg        sync.WaitGroup
+	ready     chan struct{} // Is close once the listener is listening
+	readyOnce sync.Once
+	stop      chan struct{}
 }
 
 // Ready returns a channel which is closed once the listener is
@@ -118,6 +175,12 @@ func (l *Listener) Ready() <-chan struct{} {
 	return l.ready
 }
 
+// setReady closes the ready channel. It may be called more than once
+// when a listener receives on more than one socket.
+func (l *Listener) setReady() {
+	l.readyOnce.Do(func() { close(l.ready) })
+}
+
 func (l *Listener) Stop() {
 	close(l.stop)
 	l.wg.Wait()
@@ -130,16 +193,45 @@ func newListener(c *config.Config) (*Listener, error) {
 		ready: make(chan struct{}),
 		stop:  make(chan struct{}),
 		stats: stats.New(allStats...),
-		buf:   make([]byte, c.ListenerBatchBytes),
+		batch: newBatch(c.NATSSubject[0], c.ListenerBatchBytes),
+		conns: make(map[*streamConn]struct{}),
+
+		dbBatches: make(map[string]*batch),
 
 		// If more than batchSizeThreshold bytes has been written to
 		// the current batch buffer, the batch will be sent. We allow
 		// for the maximum UDP datagram size to be read from the
 		// socket (unlikely but possible).
 		batchSizeThreshold: c.ListenerBatchBytes - udpMaxDatagramSize,
+
+		batchMaxAge:  time.Duration(c.ListenerBatchMaxMS) * time.Millisecond,
+		maxBodyBytes: int64(c.ListenerMaxBodyMB) * 1024 * 1024,
+	}
+
+	if c.ListenerDefaultPrecision != "" {
+		mult, err := precisionToMultiplier(c.ListenerDefaultPrecision)
+		if err != nil {
+			return nil, fmt.Errorf("listener_default_precision: %v", err)
+		}
+		l.precisionMult = mult
+	}
+
+	limiter, err := newRateLimiter(c.ListenerRateLimits)
+	if err != nil {
+		return nil, err
 	}
+	l.limiter = limiter
 
-	nc, err := nats.Connect(l.c.NATSAddress)
+	l.natsBufferLimit = nats.DefaultReconnectBufSize
+	if c.ListenerNATSBufferMB > 0 {
+		l.natsBufferLimit = int64(c.ListenerNATSBufferMB) * 1024 * 1024
+	}
+	nc, err := nats.Connect(l.c.NATSAddress,
+		natsReconnectBufSize(int(l.natsBufferLimit)),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			atomic.StoreInt64(&l.natsBuffered, 0)
+		}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -181,23 +273,68 @@ func roundUpToPageSize(n int) int {
 	return (n + pageSize - 1) / pageSize * pageSize
 }
 
-func (l *Listener) listenUDP(sc *net.UDPConn) {
+// datagramConn is implemented by *net.UDPConn and *net.UnixConn.
+type datagramConn interface {
+	net.Conn
+	ReadFrom([]byte) (int, net.Addr, error)
+}
+
+// listenDatagrams reads datagrams from a UDP or Unix datagram socket
+// and adds them to the batch. Datagrams from sources which are over
+// their rate limit are dropped.
+func (l *Listener) listenDatagrams(sc datagramConn) {
 	defer func() {
 		sc.Close()
 		l.wg.Done()
 	}()
 
-	close(l.ready)
+	// When lines need to be validated or have their timestamps
+	// converted, datagrams are read into a separate buffer first.
+	// Otherwise they are read straight into the batch buffer. This is
+	// only done when no other goroutine adds to the batch: the
+	// Graphite listener shares its batch with a stream listener but
+	// always processes datagrams.
+	var readBuf []byte
+	var dp *datagramProcessor
+	if l.processDatagrams() {
+		readBuf = make([]byte, udpMaxDatagramSize)
+		dp = l.newDatagramProcessor(l.batch)
+	}
+
+	b := l.batch
+	l.setReady()
 	for {
-		sc.SetReadDeadline(time.Now().Add(time.Second))
-		sz, _, err := sc.ReadFromUDP(l.buf[l.batchSize:])
+		sc.SetReadDeadline(l.readDeadline(b))
+		buf := readBuf
+		if buf == nil {
+			// Leave room to newline terminate the datagram.
+			buf = b.buf[b.size : len(b.buf)-1]
+		}
+		var sz int
+		var err error
+		if l.limiter == nil {
+			sz, err = sc.Read(buf)
+		} else {
+			var addr net.Addr
+			sz, addr, err = sc.ReadFrom(buf)
+			if sz > 0 && !l.allowDatagram(sourceIP(addr), buf[:sz]) {
+				sz = 0
+			}
+		}
 		if err != nil && !isTimeout(err) {
 			l.stats.Inc(readErrors)
 		}
 
 		// Attempt to process the read even on error as Read may
 		// still have read some bytes successfully.
-		l.processRead(sz)
+		if readBuf == nil {
+			b.mu.Lock()
+			l.processRead(b, terminateDatagram(b.buf[b.size:], sz))
+			b.mu.Unlock()
+		} else if sz > 0 {
+			dp.Add(readBuf[:sz])
+		}
+		l.sendExpiredBatch(b)
 
 		select {
 		case <-l.stop:
@@ -207,54 +344,94 @@ func (l *Listener) listenUDP(sc *net.UDPConn) {
 	}
 }
 
-func (l *Listener) setupHTTP() *http.Server {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
-		for {
-			sz, err := r.Body.Read(l.buf[l.batchSize:])
-
-			// Attempt to process the read even on error has Read may
-			// still have read some bytes successfully.
-			l.processRead(sz)
-
-			if err != nil {
-				if err != io.EOF {
-					l.stats.Inc(readErrors)
-				}
-				break
-			}
+// allowDatagram returns true if a datagram from ip is within the
+// sender's rate limit.
+func (l *Listener) allowDatagram(ip net.IP, datagram []byte) bool {
+	if l.limiter.Allow(l.limiter.IPSource(ip), countLines(datagram)) {
+		return true
+	}
+	if l.c.Debug {
+		log.Printf("dropping datagram from %s: rate limit exceeded", ip)
+	}
+	return false
+}
+
+// readDeadline returns the time that a datagram listener should wait
+// until for a read. This is normally a second away but will be sooner
+// if the batch is due to be sent before then.
+func (l *Listener) readDeadline(b *batch) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	if l.batchMaxAge > 0 && b.complete > 0 {
+		if expiry := b.created.Add(l.batchMaxAge); expiry.Before(deadline) {
+			return expiry
 		}
-	})
-	return &http.Server{
-		Addr:    fmt.Sprintf(":%d", l.c.Port),
-		Handler: mux,
 	}
+	return deadline
 }
 
-func (l *Listener) listenHTTP(server *http.Server) {
-	defer l.wg.Done()
+// appendBatch copies lines to the end of a batch buffer and then
+// processes them as a read. Unlike reading directly into the batch
+// buffer, it is safe to call from multiple goroutines as the batch's
+// lock is held. lines must only contain complete, newline terminated
+// lines but may be of any size: the batch is sent early if there
+// isn't room for them.
+func (l *Listener) appendBatch(b *batch, lines []byte) {
+	if len(lines) == 0 {
+		return
+	}
 
-	go func() {
-		close(l.ready)
-		err := server.ListenAndServe()
-		if err == nil || err == http.ErrServerClosed {
-			return
+	b.mu.Lock()
+	for b.evicted {
+		// The batch was removed while the lines were being prepared.
+		b.mu.Unlock()
+		b = l.dbBatch(b.subject)
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+	b.lastUsed = time.Now()
+
+	for len(lines) > 0 {
+		chunk := lines
+		if room := len(b.buf) - b.size; len(chunk) > room {
+			if b.complete > 0 {
+				l.sendBatch(b)
+				continue
+			}
+			// More lines than can fit in an empty batch buffer.
+			// Fill it with as many lines as possible.
+			i := bytes.LastIndexByte(chunk[:room], '\n')
+			if i == -1 {
+				log.Printf("dropping line longer than the batch buffer (%d bytes)", room)
+				return
+			}
+			chunk = chunk[:i+1]
 		}
-		log.Fatal(err)
-	}()
-
-	// Close the server if the stop channel is closed.
-	<-l.stop
-	server.Close()
+		sz := copy(b.buf[b.size:], chunk)
+		l.processRead(b, sz)
+		lines = lines[sz:]
+	}
 }
 
-func (l *Listener) processRead(sz int) {
+// processRead accounts for sz bytes which have just been added to the
+// end of a batch, sending the batch if required. The bytes don't need
+// to end with a complete line: only complete lines are ever sent.
+func (l *Listener) processRead(b *batch, sz int) {
 	if sz < 1 {
 		return // Empty read
 	}
 
-	linesReceived := l.stats.Inc(linesReceived)
-	l.batchSize += sz
+	l.stats.Inc(linesReceived)
+	if b.size == 0 {
+		b.created = time.Now()
+	}
+	if i := bytes.LastIndexByte(b.buf[b.size:b.size+sz], '\n'); i >= 0 {
+		b.complete = b.size + i + 1
+	}
+	b.size += sz
+	b.reads++
 
 	if l.c.Debug {
 		log.Printf("listener read %d bytes\n", sz)
@@ -262,19 +439,220 @@ func (l *Listener) processRead(sz int) {
 
 	// Send when sufficient reads have been batched or the batch
 	// buffer is almost full.
-	if linesReceived%l.c.BatchMessages == 0 || l.batchSize > l.batchSizeThreshold {
-		l.stats.Inc(batchesSent)
-		if err := l.nc.Publish(l.c.NATSSubject[0], l.buf[:l.batchSize]); err != nil {
-			l.handleNatsError(err)
+	if b.reads >= l.c.BatchMessages || b.size > l.batchSizeThreshold {
+		l.sendBatch(b)
+	}
+}
+
+// batchExpired returns true if a batch with complete lines has been
+// held for longer than the configured maximum batch age.
+func (l *Listener) batchExpired(b *batch) bool {
+	return l.batchMaxAge > 0 && b.complete > 0 &&
+		time.Since(b.created) >= l.batchMaxAge
+}
+
+// sendExpiredBatch sends a batch if it has expired. Unlike
+// batchExpired and sendBatch, it takes the batch's lock.
+func (l *Listener) sendExpiredBatch(b *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if l.batchExpired(b) {
+		l.sendBatch(b)
+	}
+}
+
+// sendBatch publishes the complete lines in a batch. A partial line
+// at the end of the batch is moved to the start of the batch buffer
+// so that it can be completed by later reads.
+func (l *Listener) sendBatch(b *batch) {
+	b.reads = 0
+	if b.complete == 0 {
+		if b.size > l.batchSizeThreshold {
+			// No room for the rest of the line.
+			log.Printf("dropping partial line longer than %d bytes", b.size)
+			l.stats.Inc(readErrors)
+			b.size = 0
+		}
+		return
+	}
+
+	l.stats.Inc(batchesSent)
+	if l.nc.IsReconnecting() {
+		atomic.AddInt64(&l.natsBuffered, int64(b.complete))
+	}
+	if err := l.nc.Publish(b.subject, b.buf[:b.complete]); err != nil {
+		l.handleNatsError(err)
+	}
+	b.size = copy(b.buf, b.buf[b.complete:b.size])
+	b.complete = 0
+	if b.size > 0 {
+		b.created = time.Now()
+	}
+}
+
+// dbBatch returns the batch for a NATS subject which HTTP writes are
+// routed to, creating it if necessary.
+//
+// The number of batches for subjects created from
+// listener_db_subject_template is limited by listener_db_subjects_max.
+// Once the limit is reached, writes for other subjects use the batch
+// for the default subject until idle batches have been removed (see
+// startBatchFlusher).
+func (l *Listener) dbBatch(subject string) *batch {
+	if subject == l.batch.subject {
+		return l.batch
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b := l.dbBatches[subject]; b != nil {
+		return b
+	}
+
+	templated := !l.isExplicitSubject(subject)
+	if templated {
+		if max := l.c.ListenerDBSubjectsMax; max > 0 && l.templatedBatches >= max {
+			if l.c.Debug {
+				log.Printf("routing writes for %s to the default subject: listener_db_subjects_max (%d) reached",
+					subject, max)
+			}
+			return l.batch
+		}
+		l.templatedBatches++
+	}
+	b := newBatch(subject, l.c.ListenerBatchBytes)
+	b.templated = templated
+	b.lastUsed = time.Now()
+	l.dbBatches[subject] = b
+	return b
+}
+
+// isExplicitSubject returns true if subject is one of the subjects in
+// listener_db_subjects.
+func (l *Listener) isExplicitSubject(subject string) bool {
+	for _, s := range l.c.ListenerDBSubjects {
+		if s == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// flushDBBatches sends the database batches which have expired and
+// removes those which are empty and haven't been written to for
+// dbBatchIdleTimeout. It returns the time until the batches will next
+// need to be checked, or wait if that is sooner.
+func (l *Listener) flushDBBatches(wait time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for subject, b := range l.dbBatches {
+		b.mu.Lock()
+		wait = l.flushBatch(b, wait)
+		if b.size == 0 && time.Since(b.lastUsed) >= dbBatchIdleTimeout {
+			b.evicted = true
+			delete(l.dbBatches, subject)
+			if b.templated {
+				l.templatedBatches--
+			}
 		}
-		l.batchSize = 0
+		b.mu.Unlock()
 	}
+	return wait
+}
+
+// startBatchFlusher sends the current batch whenever it has been held
+// for longer than the configured maximum batch age. It is used by the
+// listeners which add to the batch buffer using appendBatch. The UDP
+// listener checks the batch age itself.
+//
+// When HTTP writes are routed by database, it also removes batches
+// which have been idle for dbBatchIdleTimeout.
+func (l *Listener) startBatchFlusher() {
+	defer l.wg.Done()
+
+	routed := len(l.c.ListenerDBSubjects) > 0 || l.c.ListenerDBSubjectTemplate != ""
+	if l.batchMaxAge <= 0 && !routed {
+		return
+	}
+
+	for {
+		maxWait := l.batchMaxAge
+		if routed && (maxWait <= 0 || dbBatchIdleTimeout < maxWait) {
+			maxWait = dbBatchIdleTimeout
+		}
+
+		l.batch.mu.Lock()
+		wait := l.flushBatch(l.batch, maxWait)
+		l.batch.mu.Unlock()
+		wait = l.flushDBBatches(wait)
+
+		select {
+		case <-time.After(wait):
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// flushBatch sends a batch if it has expired. It returns the time
+// until the batch will next need to be checked, or wait if that is
+// sooner.
+func (l *Listener) flushBatch(b *batch, wait time.Duration) time.Duration {
+	if l.batchMaxAge <= 0 {
+		return wait
+	}
+	if l.batchExpired(b) {
+		l.sendBatch(b)
+	}
+	if b.complete > 0 {
+		if remaining := l.batchMaxAge - time.Since(b.created); remaining < wait {
+			return remaining
+		}
+	}
+	return wait
 }
 
 func (l *Listener) handleNatsError(err error) {
 	log.Printf("NATS Error: %v\n", err)
 }
 
+// natsReconnectBufSize sets the amount of data the NATS client will
+// buffer while reconnecting.
+func natsReconnectBufSize(size int) nats.Option {
+	return func(o *nats.Options) error {
+		o.ReconnectBufSize = size
+		return nil
+	}
+}
+
+// natsRetryAfter returns the number of seconds clients should wait
+// before retrying when NATS is unavailable. This is the time between
+// the NATS client's reconnection attempts.
+func (l *Listener) natsRetryAfter() int {
+	secs := int(l.nc.Opts.ReconnectWait / time.Second)
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
+
+// natsAvailable returns true if NATS can accept more data. This isn't
+// the case if the NATS connection is down and the NATS client's
+// reconnect buffer doesn't have room for another batch.
+func (l *Listener) natsAvailable() bool {
+	switch {
+	case l.nc.IsConnected():
+		return true
+	case l.nc.IsReconnecting():
+		return atomic.LoadInt64(&l.natsBuffered)+int64(l.c.ListenerBatchBytes) <= l.natsBufferLimit
+	default:
+		return false
+	}
+}
+
 func (l *Listener) startStatistician() {
 	defer l.wg.Done()
 
@@ -284,6 +662,11 @@ func (l *Listener) startStatistician() {
 		"received",
 		"sent",
 		"read_errors",
+		"decompress_errors",
+		"auth_failures",
+		"accepted",
+		"rejected",
+		"nats_unavailable",
 	)
 	tagVals := []string{l.c.Name}
 	for {
@@ -293,7 +676,14 @@ func (l *Listener) startStatistician() {
 			stats.Get(linesReceived),
 			stats.Get(batchesSent),
 			stats.Get(readErrors),
+			stats.Get(decompressErrors),
+			stats.Get(authFailures),
+			stats.Get(linesAccepted),
+			stats.Get(linesRejected),
+			stats.Get(natsUnavailable),
 		))
+		l.publishConnStats(l.c.Name)
+		l.publishThrottleStats(l.c.Name)
 		select {
 		case <-time.After(statsInterval):
 		case <-l.stop:
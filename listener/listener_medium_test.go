@@ -17,12 +17,24 @@
 package listener
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -112,6 +124,204 @@ func TestBatching(t *testing.T) {
 	assertMonitor(t, monitorCh, numLines, 1)
 }
 
+func TestUDPListenerMultipleSockets(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerUDPSockets = 4
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// Send from a number of source ports so that datagrams are
+	// spread over the sockets.
+	var expected []string
+	for i := 0; i < 8; i++ {
+		conn := dialListener(t)
+		for _, line := range poetry {
+			_, err := conn.Write([]byte(line))
+			require.NoError(t, err)
+			expected = append(expected, line)
+		}
+		conn.Close()
+	}
+
+	var received []string
+	for len(received) < len(expected) {
+		select {
+		case batch := <-listenerCh:
+			received = append(received, batch)
+		case <-time.After(spouttest.LongWait):
+			t.Fatalf("failed to see message (got %d of %d)", len(received), len(expected))
+		}
+	}
+	sort.Strings(expected)
+	sort.Strings(received)
+	assert.Equal(t, expected, received)
+	assertNoMore(t, listenerCh)
+}
+
+func TestUDPListenerMultipleSocketsBatchMaxAge(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerUDPSockets = 2
+	conf.BatchMessages = 99999
+	conf.ListenerBatchMaxMS = 200
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	start := time.Now()
+	for _, line := range poetry[:2] {
+		_, err := conn.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// Datagrams from the same source always go to the same socket.
+	assertBatch(t, listenerCh, poetry[0]+poetry[1])
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "batch sent too early")
+}
+
+func TestUDPListenerUnterminatedDatagrams(t *testing.T) {
+	testUDPListenerUnterminatedDatagrams(t, testConfig())
+}
+
+func TestUDPListenerUnterminatedDatagramsValidated(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerValidate = true
+	testUDPListenerUnterminatedDatagrams(t, conf)
+}
+
+func TestUDPListenerMultipleSocketsUnterminatedDatagrams(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerUDPSockets = 2
+	testUDPListenerUnterminatedDatagrams(t, conf)
+}
+
+// testUDPListenerUnterminatedDatagrams checks that the end of a
+// datagram is taken to be the end of a line, so that lines from
+// different datagrams (and hosts) are never joined.
+func testUDPListenerUnterminatedDatagrams(t *testing.T, conf *config.Config) {
+	conf.BatchMessages = 3
+	conf.ListenerBatchMaxMS = 100 // for sockets with fewer datagrams
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	connA := dialListener(t)
+	defer connA.Close()
+	connB := dialListener(t)
+	defer connB.Close()
+
+	for _, write := range []struct {
+		conn     *net.UDPConn
+		datagram string
+	}{
+		{connA, "cpu,host=a x=1"},
+		{connB, "mem,host=b y=2"},
+		{connB, "disk,host=b z=3"},
+	} {
+		_, err := write.conn.Write([]byte(write.datagram))
+		require.NoError(t, err)
+	}
+
+	// With several sockets, the datagrams may be batched separately.
+	received := ""
+	for strings.Count(received, "\n") < 3 {
+		select {
+		case batch := <-listenerCh:
+			received += batch
+		case <-time.After(spouttest.LongWait):
+			t.Fatalf("failed to see message (received %q)", received)
+		}
+	}
+	lines := strings.SplitAfter(received, "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"", "cpu,host=a x=1\n", "disk,host=b z=3\n", "mem,host=b y=2\n"}, lines)
+}
+
+// TestTCPListenerSplitLines checks that only complete lines are
+// published when lines are split across reads, at every possible
+// offset.
+func TestTCPListenerSplitLines(t *testing.T) {
+	listener := startTCPListener(t, testConfig())
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	conn.SetNoDelay(true)
+
+	all := "foo,host=a x=1 1\nbar y=2i\nbaz s=\"hello world\" 3\n"
+	for i := 1; i < len(all); i++ {
+		for _, chunk := range []string{all[:i], all[i:]} {
+			_, err := conn.Write([]byte(chunk))
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+		}
+
+		received := ""
+		for len(received) < len(all) {
+			select {
+			case batch := <-listenerCh:
+				require.True(t, strings.HasSuffix(batch, "\n"),
+					"partial line with split at %d: %q", i, batch)
+				received += batch
+			case <-time.After(spouttest.LongWait):
+				t.Fatalf("failed to see message with split at %d", i)
+			}
+		}
+		require.Equal(t, all, received, "split at %d", i)
+	}
+	assertNoMore(t, listenerCh)
+}
+
+func TestUDPListenerRateLimit(t *testing.T) {
+	testUDPListenerRateLimit(t, testConfig())
+}
+
+func TestUDPListenerMultipleSocketsRateLimit(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerUDPSockets = 2
+	testUDPListenerRateLimit(t, conf)
+}
+
+func testUDPListenerRateLimit(t *testing.T, conf *config.Config) {
+	conf.ListenerRateLimits = []config.RateLimit{
+		{CIDR: "127.0.0.0/8", LinesPerSec: 1, Burst: 2},
+	}
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	for _, line := range poetry {
+		_, err := conn.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// Only the burst should get through.
+	assertBatch(t, listenerCh, poetry[0])
+	assertBatch(t, listenerCh, poetry[1])
+	assertNoMore(t, listenerCh)
+
+	assertMonitor(t, monitorCh, 2, 2)
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener_throttle,listener=testlistener,source=127.0.0.1 lines=2,throttled=3\n")
+}
+
 func TestWhatComesAroundGoesAround(t *testing.T) {
 	listener := startListener(t, testConfig())
 	defer listener.Stop()
@@ -119,68 +329,1291 @@ func TestWhatComesAroundGoesAround(t *testing.T) {
 	listenerCh, unsubListener := subListener(t)
 	defer unsubListener()
 
-	monitorCh, unsubMonitor := subMonitor(t)
-	defer unsubMonitor()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	// Send some lines to the listener.
+	conn := dialListener(t)
+	defer conn.Close()
+	for _, line := range poetry {
+		_, err := conn.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < numLines; i++ {
+		assertBatch(t, listenerCh, poetry[i])
+	}
+	assertNoMore(t, listenerCh)
+
+	assertMonitor(t, monitorCh, numLines, numLines)
+}
+
+func TestBatchBufferFull(t *testing.T) {
+	conf := testConfig()
+	// Set batch size high so that the batch will only send due to the
+	// batch buffer filling up.
+	conf.BatchMessages = 99999
+
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// Keep sending to the listener until it emits a batch.
+	conn := dialListener(t)
+	defer conn.Close()
+	msg := make([]byte, 100)
+	timeout := time.After(spouttest.LongWait)
+	writeCount := 0
+loop:
+	for {
+		_, err := conn.Write(msg)
+		require.NoError(t, err)
+		writeCount++
+
+		select {
+		case <-listenerCh:
+			break loop
+		case <-time.After(time.Microsecond):
+			// Send again
+		case <-timeout:
+			t.Fatal("no message seen")
+		}
+	}
+
+	assertNoMore(t, listenerCh)
+
+	// Ensure that batch was output because batch size limit was
+	// reached, not the message count.
+	assert.True(t, writeCount < conf.BatchMessages,
+		fmt.Sprintf("writeCount = %d", writeCount))
+}
+
+func TestBatchMaxAge(t *testing.T) {
+	conf := testConfig()
+	// Set batch size high so that the batch will only send due to
+	// its age.
+	conf.BatchMessages = 99999
+	conf.ListenerBatchMaxMS = 200
+
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	start := time.Now()
+	for _, line := range poetry[:2] {
+		_, err := conn.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	assertBatch(t, listenerCh, poetry[0]+poetry[1])
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "batch sent too early")
+	assertNoMore(t, listenerCh)
+}
+
+func TestHTTPListener(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	// Send some lines to the listener.
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	for _, line := range poetry {
+		_, err := http.Post(url, "text/plain", bytes.NewBufferString(line))
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < numLines; i++ {
+		assertBatch(t, listenerCh, poetry[i])
+	}
+	assertNoMore(t, listenerCh)
+
+	assertMonitor(t, monitorCh, numLines, numLines)
+}
+
+func TestTCPListener(t *testing.T) {
+	listener := startTCPListener(t, testConfig())
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+
+	// Send the lines with writes which don't line up with line
+	// boundaries.
+	all := strings.Join(poetry, "")
+	for _, chunk := range []string{all[:10], all[10:50], all[50:51], all[51:]} {
+		_, err := conn.Write([]byte(chunk))
+		require.NoError(t, err)
+		time.Sleep(spouttest.ShortWait)
+	}
+
+	// Each batch should only ever contain complete lines.
+	received := ""
+	for len(received) < len(all) {
+		select {
+		case batch := <-listenerCh:
+			assert.True(t, strings.HasSuffix(batch, "\n"), "partial line: %q", batch)
+			received += batch
+		case <-time.After(spouttest.LongWait):
+			t.Fatal("failed to see message")
+		}
+	}
+	assert.Equal(t, all, received)
+	assertNoMore(t, listenerCh)
+
+	assertConnMonitor(t, monitorCh, conn, numLines, len(all))
+
+	// Stats for connections from the same host are combined.
+	conn2 := dialTCPListener(t)
+	defer conn2.Close()
+	_, err := conn2.Write([]byte(poetry[0]))
+	require.NoError(t, err)
+	assertConnMonitor(t, monitorCh, conn, numLines+1, len(all)+len(poetry[0]))
+}
+
+func TestTCPListenerFinalLine(t *testing.T) {
+	listener := startTCPListener(t, testConfig())
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// A line without a trailing newline should still be sent when
+	// the connection is closed.
+	conn := dialTCPListener(t)
+	_, err := conn.Write([]byte("no newline"))
+	require.NoError(t, err)
+	assertNoMore(t, listenerCh)
+	conn.Close()
+
+	assertBatch(t, listenerCh, "no newline\n")
+}
+
+func TestTCPListenerMaxConnections(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerMaxConnections = 1
+	listener := startTCPListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	_, err := conn.Write([]byte(poetry[0]))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, poetry[0])
+
+	// The second connection should be closed by the listener.
+	conn2 := dialTCPListener(t)
+	defer conn2.Close()
+	assertClosedByListener(t, conn2)
+
+	// The first connection should still work.
+	_, err = conn.Write([]byte(poetry[1]))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, poetry[1])
+}
+
+func TestTCPListenerIdleTimeout(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerIdleTimeoutSecs = 1
+	listener := startTCPListener(t, conf)
+	defer listener.Stop()
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	assertClosedByListener(t, conn)
+}
+
+func TestGraphiteListener(t *testing.T) {
+	conf := testConfig()
+	conf.GraphiteTemplates = []string{"servers.* .host.measurement*", "measurement* env=prod"}
+	conf.GraphiteSeparator = "."
+	listener, err := StartGraphiteListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	// TCP
+	tcpConn := dialTCPListener(t)
+	defer tcpConn.Close()
+	_, err = tcpConn.Write([]byte("servers.web01.cpu.load 0.5 1500000000\nbad\n"))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, "cpu.load,host=web01 value=0.5 1500000000000000000\n")
+
+	// UDP, where the final line doesn't need a newline.
+	udpConn := dialListener(t)
+	defer udpConn.Close()
+	_, err = udpConn.Write([]byte("mem.free 1024 1500000000\nmem.used 10 1500000000"))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, "mem.free,env=prod value=1024 1500000000000000000\n"+
+		"mem.used,env=prod value=10 1500000000000000000\n")
+	assertNoMore(t, listenerCh)
+
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=2,sent=2,read_errors=0,decompress_errors=0,auth_failures=0,accepted=0,rejected=1,nats_unavailable=0\n")
+}
+
+func TestGraphiteListenerConcurrent(t *testing.T) {
+	// Lines arriving over TCP and UDP at the same time share a batch
+	// which is also sent by the batch flusher. Run with -race.
+	conf := testConfig()
+	conf.BatchMessages = 99999
+	conf.ListenerBatchMaxMS = 10
+	listener, err := StartGraphiteListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	const count = 200
+	tcpConn := dialTCPListener(t)
+	defer tcpConn.Close()
+	udpConn := dialListener(t)
+	defer udpConn.Close()
+
+	var wg sync.WaitGroup
+	send := func(conn net.Conn, measurement string) {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			_, err := fmt.Fprintf(conn, "%s %d 1500000000\n", measurement, i)
+			assert.NoError(t, err)
+			if i%20 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}
+	wg.Add(2)
+	go send(tcpConn, "tcp")
+	go send(udpConn, "udp")
+	wg.Wait()
+
+	received := map[string]int{}
+	timeout := time.After(spouttest.LongWait)
+	for received["tcp"]+received["udp"] < 2*count {
+		select {
+		case batch := <-listenerCh:
+			for _, line := range strings.SplitAfter(batch, "\n") {
+				if line != "" {
+					received[line[:strings.IndexByte(line, ' ')]]++
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out with %v lines received", received)
+		}
+	}
+	assert.Equal(t, map[string]int{"tcp": count, "udp": count}, received)
+}
+
+func TestGraphiteListenerInvalidTemplate(t *testing.T) {
+	conf := testConfig()
+	conf.GraphiteTemplates = []string{"host.cpu"}
+	_, err := StartGraphiteListener(conf)
+	assert.EqualError(t, err, `invalid graphite template "host.cpu": no measurement specified`)
+}
+
+func TestStatsdListener(t *testing.T) {
+	conf := testConfig()
+	conf.StatsdFlushIntervalMS = 500
+	listener, err := StartStatsdListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:1|c|#host:web01\nhits:2|c|#host:web01\ntemp:20|g\nbad\n"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("users:alice|s"))
+	require.NoError(t, err)
+
+	ts := `\d{19}\n`
+	assertBatchMatches(t, listenerCh,
+		"^hits,host=web01 value=3 "+ts+"temp value=20 "+ts+"users value=1 "+ts+"$")
+
+	// Only the gauge is sent with the next flush.
+	assertBatchMatches(t, listenerCh, "^temp value=20 "+ts+"$")
+}
+
+func TestStatsdListenerStop(t *testing.T) {
+	conf := testConfig()
+	conf.StatsdFlushIntervalMS = 60000
+	listener, err := StartStatsdListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:1|c"))
+	require.NoError(t, err)
+	time.Sleep(spouttest.ShortWait)
+
+	// Metrics are flushed when the listener stops.
+	listener.Stop()
+	assertBatchMatches(t, listenerCh, `^hits value=1 \d{19}\n$`)
+}
+
+func TestStatsdListenerInvalidConfig(t *testing.T) {
+	conf := testConfig()
+	_, err := StartStatsdListener(conf)
+	assert.EqualError(t, err, "statsd_flush_interval_ms must be greater than 0")
+
+	conf.StatsdFlushIntervalMS = 1000
+	conf.StatsdPercentiles = []float64{90, 101}
+	_, err = StartStatsdListener(conf)
+	assert.EqualError(t, err, "invalid statsd percentile 101")
+}
+
+func TestOpenTSDBListener(t *testing.T) {
+	listener, err := StartOpenTSDBListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	// Telnet style put commands. The version command is answered
+	// (tcollector uses it as a keepalive) while stats and help are
+	// ignored. Other commands are rejected.
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	_, err = conn.Write([]byte("put sys.cpu 1500000000 0.5 host=web01\nversion\nstats\nhelp\ndrop\n"))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, "sys.cpu,host=web01 value=0.5 1500000000000000000\n")
+	conn.SetReadDeadline(time.Now().Add(spouttest.LongWait))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, openTSDBVersion, reply)
+
+	// HTTP on the same port.
+	url := fmt.Sprintf("http://localhost:%d/api/put", listenPort)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(`[
+		{"metric": "sys.mem", "timestamp": 1500000000000, "value": 1024, "tags": {"host": "web01"}},
+		{"metric": "sys.mem", "timestamp": 1500000000000, "value": "x"}
+	]`))
+	require.NoError(t, err)
+	assertErrorBody(t, resp, "datapoint 1: invalid value")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertBatch(t, listenerCh, "sys.mem,host=web01 value=1024 1500000000000000000\n")
+
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(
+		`{"metric": "sys.disk", "timestamp": 1500000000, "value": 1}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, "sys.disk value=1 1500000000000000000\n")
+	assertNoMore(t, listenerCh)
+
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=3,sent=3,read_errors=0,decompress_errors=0,auth_failures=0,accepted=0,rejected=2,nats_unavailable=0\n")
+}
+
+func TestOpenTSDBListenerMaxConnections(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerMaxConnections = 1
+	listener, err := StartOpenTSDBListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// An HTTP connection counts towards the limit while it is kept
+	// open.
+	httpConn := dialTCPListener(t)
+	defer httpConn.Close()
+	body := `{"metric": "sys.disk", "timestamp": 1500000000, "value": 1}`
+	_, err = fmt.Fprintf(httpConn, "POST /api/put HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Length: %d\r\n\r\n%s", len(body), body)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(httpConn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, "sys.disk value=1 1500000000000000000\n")
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	assertClosedByListener(t, conn)
+
+	// Once the HTTP connection is closed, another connection can be
+	// made.
+	httpConn.Close()
+	waitForNoConns(t, listener)
+	conn = dialTCPListener(t)
+	defer conn.Close()
+	_, err = conn.Write([]byte("put sys.cpu 1500000000 0.5\n"))
+	require.NoError(t, err)
+	assertBatch(t, listenerCh, "sys.cpu value=0.5 1500000000000000000\n")
+}
+
+func TestOpenTSDBListenerIdleTimeout(t *testing.T) {
+	// Connections which never send anything are closed before they
+	// are routed to the HTTP server or the telnet style handler.
+	conf := testConfig()
+	conf.ListenerIdleTimeoutSecs = 1
+	listener, err := StartOpenTSDBListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	conn := dialTCPListener(t)
+	defer conn.Close()
+	assertClosedByListener(t, conn)
+	waitForNoConns(t, listener)
+}
+
+func TestUnixListenerStream(t *testing.T) {
+	conf, cleanup := unixTestConfig(t, "stream")
+	defer cleanup()
+	conf.ListenerSocketMode = "0600"
+	listener := startUnixListener(t, conf)
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	info, err := os.Stat(conf.ListenerSocketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The socket is bound in a temporary directory which is removed
+	// once the socket has been moved into place.
+	assertDirContents(t, filepath.Dir(conf.ListenerSocketPath), "spout.sock")
+
+	conn, err := net.Dial("unix", conf.ListenerSocketPath)
+	require.NoError(t, err)
+	all := strings.Join(poetry, "")
+	_, err = conn.Write([]byte(all))
+	require.NoError(t, err)
+
+	received := ""
+	for len(received) < len(all) {
+		select {
+		case batch := <-listenerCh:
+			received += batch
+		case <-time.After(spouttest.LongWait):
+			t.Fatal("failed to see message")
+		}
+	}
+	assert.Equal(t, all, received)
+
+	assertMonitorLine(t, monitorCh, fmt.Sprintf(
+		"spout_stat_listener_conn,listener=testlistener,remote=unix lines=%d,bytes=%d\n",
+		numLines, len(all)))
+	conn.Close()
+
+	// The socket file is removed when the listener stops.
+	listener.Stop()
+	_, err = os.Stat(conf.ListenerSocketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixListenerDatagram(t *testing.T) {
+	conf, cleanup := unixTestConfig(t, "datagram")
+	defer cleanup()
+	conf.BatchMessages = 2
+
+	// A stale socket left behind should be replaced.
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: conf.ListenerSocketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	stale.Close()
+	_, err = os.Stat(conf.ListenerSocketPath)
+	require.NoError(t, err)
+
+	listener := startUnixListener(t, conf)
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn, err := net.Dial("unixgram", conf.ListenerSocketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, line := range poetry[:2] {
+		_, err := conn.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	assertBatch(t, listenerCh, poetry[0]+poetry[1])
+
+	listener.Stop()
+	_, err = os.Stat(conf.ListenerSocketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixListenerErrors(t *testing.T) {
+	conf, cleanup := unixTestConfig(t, "carrier-pigeon")
+	defer cleanup()
+	_, err := StartUnixListener(conf)
+	assert.EqualError(t, err, `invalid listener_socket_type "carrier-pigeon" (use stream or datagram)`)
+
+	conf.ListenerSocketType = "stream"
+	conf.ListenerSocketMode = "rwx"
+	_, err = StartUnixListener(conf)
+	assert.EqualError(t, err, `invalid listener_socket_mode "rwx"`)
+
+	// Nothing is left behind when the socket can't be set up.
+	conf.ListenerSocketMode = ""
+	conf.ListenerSocketOwner = "no-such-user-here"
+	_, err = StartUnixListener(conf)
+	assert.Contains(t, fmt.Sprint(err), "invalid listener_socket_owner")
+	assertDirContents(t, filepath.Dir(conf.ListenerSocketPath))
+	conf.ListenerSocketOwner = ""
+
+	// Regular files at the socket path aren't touched.
+	require.NoError(t, ioutil.WriteFile(conf.ListenerSocketPath, nil, 0600))
+	conf.ListenerSocketMode = ""
+	_, err = StartUnixListener(conf)
+	assert.EqualError(t, err, conf.ListenerSocketPath+" exists and is not a socket")
+
+	conf.ListenerSocketPath = ""
+	_, err = StartUnixListener(conf)
+	assert.EqualError(t, err, "listener_socket_path must be set")
+}
+
+func TestHTTPListenerStatus(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	resp, err := http.Post(url, "text/plain", bytes.NewBufferString(poetry[0]))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "influx-spout", resp.Header.Get("X-Influxdb-Version"))
+
+	resp, err = http.Get(url)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+	assertErrorBody(t, resp, "method not allowed")
+}
+
+func TestHTTPListenerPing(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	url := fmt.Sprintf("http://localhost:%d/ping", listenPort)
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "influx-spout", resp.Header.Get("X-Influxdb-Version"))
+	}
+
+	resp, err := http.Post(url, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHTTPListenerMalformedLines(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// The valid lines should still be accepted.
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	body := "foo x=1\nbad\nbar y=2\n"
+	resp, err := http.Post(url, "text/plain", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertErrorBody(t, resp, "unable to parse 'bad': missing fields")
+
+	assertBatch(t, listenerCh, "foo x=1\nbar y=2\n")
+	assertNoMore(t, listenerCh)
+}
+
+func TestHTTPListenerQueryParams(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	url := fmt.Sprintf("http://localhost:%d/write?db=foo&rp=bar&precision=s", listenPort)
+	resp, err := http.Post(url, "text/plain", bytes.NewBufferString("foo x=1 1500000000\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, "foo x=1 1500000000000000000\n")
+
+	url = fmt.Sprintf("http://localhost:%d/write?precision=fortnight", listenPort)
+	resp, err = http.Post(url, "text/plain", bytes.NewBufferString(poetry[0]))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertErrorBody(t, resp, `invalid precision "fortnight" (use n, u, ms, s, m or h)`)
+	assertNoMore(t, listenerCh)
+}
+
+func TestHTTPListenerDBRouting(t *testing.T) {
+	conf := testConfig()
+	conf.BatchMessages = 1
+	conf.ListenerDBSubjects = map[string]string{"special": natsSubject + "-special"}
+	conf.ListenerDBSubjectTemplate = natsSubject + ".db.{db}"
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	specialCh, unsubSpecial := subscribe(t, natsSubject+"-special")
+	defer unsubSpecial()
+	fooCh, unsubFoo := subscribe(t, natsSubject+".db.foo")
+	defer unsubFoo()
+	barCh, unsubBar := subscribe(t, natsSubject+".db.bar")
+	defer unsubBar()
+
+	post := func(query, body string) *http.Response {
+		url := fmt.Sprintf("http://localhost:%d/write%s", listenPort, query)
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := post("?db=foo", poetry[0])
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, fooCh, poetry[0])
+
+	// The retention policy is ignored: writes are routed by database
+	// only and their lines are published unchanged.
+	resp = post("?db=foo&rp=short", poetry[0])
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, fooCh, poetry[0])
+
+	resp = post("?db=bar", poetry[1])
+	resp.Body.Close()
+	assertBatch(t, barCh, poetry[1])
+
+	resp = post("?db=special", poetry[2])
+	resp.Body.Close()
+	assertBatch(t, specialCh, poetry[2])
+
+	// No database uses the default subject.
+	resp = post("", poetry[3])
+	resp.Body.Close()
+	assertBatch(t, listenerCh, poetry[3])
+
+	// Database names which can't be used in a subject are rejected.
+	resp = post("?db=foo.bar", poetry[4])
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertErrorBody(t, resp, `database name "foo.bar" can't be used in a NATS subject`)
+
+	assertNoMore(t, listenerCh)
+	assertNoMore(t, fooCh)
+	assertNoMore(t, barCh)
+	assertNoMore(t, specialCh)
+}
+
+func TestHTTPListenerDBBatchMaxAge(t *testing.T) {
+	conf := testConfig()
+	conf.BatchMessages = 99999
+	conf.ListenerBatchMaxMS = 200
+	conf.ListenerDBSubjectTemplate = natsSubject + ".db.{db}"
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	fooCh, unsubFoo := subscribe(t, natsSubject+".db.foo")
+	defer unsubFoo()
+
+	url := fmt.Sprintf("http://localhost:%d/write?db=foo", listenPort)
+	start := time.Now()
+	for _, line := range poetry[:2] {
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(line))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assertBatch(t, fooCh, poetry[0]+poetry[1])
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "batch sent too early")
+}
+
+func TestHTTPListenerDBSubjectsMax(t *testing.T) {
+	defer func(timeout time.Duration) { dbBatchIdleTimeout = timeout }(dbBatchIdleTimeout)
+	dbBatchIdleTimeout = 200 * time.Millisecond
+
+	conf := testConfig()
+	conf.BatchMessages = 1
+	conf.ListenerDBSubjects = map[string]string{"special": natsSubject + "-special"}
+	conf.ListenerDBSubjectTemplate = natsSubject + ".db.{db}"
+	conf.ListenerDBSubjectsMax = 2
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	specialCh, unsubSpecial := subscribe(t, natsSubject+"-special")
+	defer unsubSpecial()
+	dbCh, unsubDB := subscribe(t, natsSubject+".db.*")
+	defer unsubDB()
+	qazCh, unsubQaz := subscribe(t, natsSubject+".db.qaz")
+	defer unsubQaz()
+
+	post := func(db, body string) {
+		url := fmt.Sprintf("http://localhost:%d/write?db=%s", listenPort, db)
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	post("foo", poetry[0])
+	assertBatch(t, dbCh, poetry[0])
+	post("bar", poetry[1])
+	assertBatch(t, dbCh, poetry[1])
+
+	// The limit has been reached so further databases use the default
+	// subject.
+	post("qaz", poetry[2])
+	assertBatch(t, listenerCh, poetry[2])
+
+	// Existing subjects and explicitly configured subjects are still
+	// used.
+	post("foo", poetry[3])
+	assertBatch(t, dbCh, poetry[3])
+	post("special", poetry[4])
+	assertBatch(t, specialCh, poetry[4])
+
+	// Once the batches for foo and bar are idle, they are removed,
+	// making room for qaz.
+	time.Sleep(5 * dbBatchIdleTimeout)
+	post("qaz", poetry[0])
+	assertBatch(t, qazCh, poetry[0])
+	assertBatch(t, dbCh, poetry[0])
+
+	assertNoMore(t, listenerCh)
+	assertNoMore(t, dbCh)
+	assertNoMore(t, specialCh)
+}
+
+func TestHTTPListenerInvalidDBTemplate(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerDBSubjectTemplate = "no-placeholder"
+	_, err := StartHTTPListener(conf)
+	assert.EqualError(t, err, "listener_db_subject_template must contain {db}")
+}
+
+func TestHTTPListenerAuth(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerAuthUsers = map[string]string{"alice": "secret"}
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	post := func(query string) *http.Response {
+		url := fmt.Sprintf("http://localhost:%d/write%s", listenPort, query)
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(poetry[0]))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := post("")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertErrorBody(t, resp, "unable to parse authentication credentials")
+
+	resp = post("?u=alice&p=wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertErrorBody(t, resp, "authorization failed")
+	assertNoMore(t, listenerCh)
+
+	resp = post("?u=alice&p=secret")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, poetry[0])
+
+	// /ping doesn't require authentication.
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/ping", listenPort))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=1,sent=1,read_errors=0,decompress_errors=0,auth_failures=2,accepted=0,rejected=0,nats_unavailable=0\n")
+}
+
+func TestHTTPListenerRateLimit(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerAuthUsers = map[string]string{"alice": "secret", "bob": "secret"}
+	conf.ListenerRateLimits = []config.RateLimit{
+		{CIDR: "127.0.0.0/8", LinesPerSec: 1},
+		{User: "alice", LinesPerSec: 1000},
+	}
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	lines := strings.Join(poetry, "")
+	post := func(user string) *http.Response {
+		url := fmt.Sprintf("http://127.0.0.1:%d/write?u=%s&p=secret", listenPort, user)
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(lines))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The whole request is accepted, even though it has more lines
+	// than the limit allows...
+	resp := post("bob")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, lines)
+
+	// ...but the next request is rejected until the lines have been
+	// paid for.
+	resp = post("bob")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+	assertErrorBody(t, resp, "rate limit exceeded")
+	assertNoMore(t, listenerCh)
+
+	// alice has her own limit.
+	resp = post("alice")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, lines)
+
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener_throttle,listener=testlistener,source=127.0.0.1 lines=5,throttled=1\n")
+}
+
+func TestUDPListenerValidation(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerValidate = true
+	conf.NATSSubjectInvalid = natsSubject + "-invalid"
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	invalidCh, unsubInvalid := subscribe(t, conf.NATSSubjectInvalid)
+	defer unsubInvalid()
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	_, err := conn.Write([]byte("foo x=1\nfoo x=abc\nbar,host=a y=2i 123\n"))
+	require.NoError(t, err)
+
+	assertBatch(t, listenerCh, "foo x=1\nbar,host=a y=2i 123\n")
+	assertBatch(t, invalidCh, `{"reason":"invalid field value","line":"foo x=abc"}`)
+
+	// Datagrams with only invalid lines don't count as reads.
+	_, err = conn.Write([]byte("foo\n"))
+	require.NoError(t, err)
+	assertBatch(t, invalidCh, `{"reason":"missing fields","line":"foo"}`)
+	assertNoMore(t, listenerCh)
+
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=1,sent=1,read_errors=0,decompress_errors=0,auth_failures=0,accepted=2,rejected=2,nats_unavailable=0\n")
+}
+
+func TestHTTPListenerValidation(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerValidate = true
+	conf.NATSSubjectInvalid = natsSubject + "-invalid"
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+	invalidCh, unsubInvalid := subscribe(t, conf.NATSSubjectInvalid)
+	defer unsubInvalid()
+
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	resp, err := http.Post(url, "text/plain", bytes.NewBufferString(`foo s="unterminated`+"\nbar x=1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertErrorBody(t, resp, `unable to parse 'foo s="unterminated': unterminated string field value`)
+
+	assertBatch(t, listenerCh, "bar x=1\n")
+	assertBatch(t, invalidCh, `{"reason":"unterminated string field value","line":"foo s=\"unterminated"}`)
+}
+
+func TestHTTPListenerPrecision(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerDefaultPrecision = "ms"
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	post := func(query, body string) {
+		url := fmt.Sprintf("http://localhost:%d/write%s", listenPort, query)
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	// The precision in the request takes priority.
+	post("?precision=u", "foo x=1 1500000000000000\n")
+	assertBatch(t, listenerCh, "foo x=1 1500000000000000000\n")
+
+	// Falls back to the configured default.
+	post("", `bar s="a b c" 1500000000000`+"\n")
+	assertBatch(t, listenerCh, `bar s="a b c" 1500000000000000000`+"\n")
+
+	// Lines without timestamps are given the time they were received.
+	before := time.Now().UnixNano()
+	post("", "qux x=1\n")
+	line := assertBatchPrefix(t, listenerCh, "qux x=1 ")
+	ts, err := strconv.ParseInt(strings.TrimSpace(line[len("qux x=1 "):]), 10, 64)
+	require.NoError(t, err)
+	assert.True(t, ts >= before && ts <= time.Now().UnixNano(), "unexpected timestamp: %d", ts)
+}
+
+func TestUDPListenerPrecision(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerDefaultPrecision = "s"
+	listener := startListener(t, conf)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	conn := dialListener(t)
+	defer conn.Close()
+	_, err := conn.Write([]byte("foo x=1 1500000000\nbar y=2 1500000001\n"))
+	require.NoError(t, err)
+
+	assertBatch(t, listenerCh, "foo x=1 1500000000000000000\nbar y=2 1500000001000000000\n")
+}
+
+func TestInvalidDefaultPrecision(t *testing.T) {
+	conf := testConfig()
+	conf.ListenerDefaultPrecision = "fortnight"
+	_, err := StartListener(conf)
+	assert.EqualError(t, err,
+		`listener_default_precision: invalid precision "fortnight" (use n, u, ms, s, m or h)`)
+}
+
+func TestHTTPListenerConcurrent(t *testing.T) {
+	const writers = 200
+	const linesPerWriter = 20
+
+	conf := testConfig()
+	conf.BatchMessages = 10
+	conf.ListenerBatchMaxMS = 100
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	// Have many writers send at once, with each request body being
+	// sent in small chunks which don't line up with the lines.
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	expected := make(map[string]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		body := new(bytes.Buffer)
+		for i := 0; i < linesPerWriter; i++ {
+			line := fmt.Sprintf("writer%d,line=%d value=%d\n", w, i, w*i)
+			expected[line] = true
+			body.WriteString(line)
+		}
 
-	// Send some lines to the listener.
-	conn := dialListener(t)
-	defer conn.Close()
-	for _, line := range poetry {
-		_, err := conn.Write([]byte(line))
-		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(url, "text/plain", &slowReader{body})
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
 	}
+	wg.Wait()
 
-	for i := 0; i < numLines; i++ {
-		assertBatch(t, listenerCh, poetry[i])
+	// Wait for the last partial batch to be sent due to its age.
+	received := make(map[string]bool)
+	timeout := time.After(spouttest.LongWait)
+	for len(received) < len(expected) {
+		select {
+		case batch := <-listenerCh:
+			require.True(t, strings.HasSuffix(batch, "\n"), "partial line: %q", batch)
+			for _, line := range strings.SplitAfter(batch, "\n") {
+				if line == "" {
+					continue
+				}
+				require.True(t, expected[line], "unexpected line: %q", line)
+				require.False(t, received[line], "duplicate line: %q", line)
+				received[line] = true
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for lines (saw %d of %d)", len(received), len(expected))
+		}
 	}
 	assertNoMore(t, listenerCh)
+}
 
-	assertMonitor(t, monitorCh, numLines, numLines)
+func TestHTTPListenerCompressed(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	gzipBody := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipBody)
+	gw.Write([]byte(poetry[0]))
+	gw.Close()
+	resp := postEncoded(t, "gzip", gzipBody)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, poetry[0])
+
+	deflateBody := new(bytes.Buffer)
+	zw := zlib.NewWriter(deflateBody)
+	zw.Write([]byte(poetry[1]))
+	zw.Close()
+	resp = postEncoded(t, "deflate", deflateBody)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, poetry[1])
+
+	assertNoMore(t, listenerCh)
 }
 
-func TestBatchBufferFull(t *testing.T) {
+func TestHTTPListenerDecompressErrors(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	monitorCh, unsubMonitor := subMonitor(t)
+	defer unsubMonitor()
+
+	// Not gzip data at all.
+	resp := postEncoded(t, "gzip", bytes.NewBufferString(poetry[0]))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Corrupted gzip data.
+	body := new(bytes.Buffer)
+	gw := gzip.NewWriter(body)
+	gw.Write([]byte(poetry[0]))
+	gw.Close()
+	corrupt := body.Bytes()
+	corrupt[10] = 0xff // first deflate block header (invalid type)
+	resp = postEncoded(t, "gzip", bytes.NewBuffer(corrupt))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Unsupported encoding.
+	resp = postEncoded(t, "br", bytes.NewBufferString(poetry[0]))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	assertNoMore(t, listenerCh)
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=0,sent=0,read_errors=0,decompress_errors=3,auth_failures=0,accepted=0,rejected=0,nats_unavailable=0\n")
+}
+
+func TestHTTPListenerMaxBody(t *testing.T) {
 	conf := testConfig()
-	// Set batch size high so that the batch will only send due to the
-	// batch buffer filling up.
-	conf.BatchMessages = 99999
+	conf.ListenerMaxBodyMB = 1
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
 
-	listener := startListener(t, conf)
+	// The limit applies to the decompressed body size.
+	body := new(bytes.Buffer)
+	gw := gzip.NewWriter(body)
+	chunk := bytes.Repeat([]byte(poetry[0]), 1000)
+	for size := 0; size <= 1024*1024; size += len(chunk) {
+		gw.Write(chunk)
+	}
+	gw.Close()
+	resp := postEncoded(t, "gzip", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestHTTPListenerNATSUnavailable(t *testing.T) {
+	// This test stops and restarts NATS so it uses its own NATS server.
+	const port = natsPort + 10
+	gnatsd := spouttest.RunGnatsd(port)
+	defer func() { gnatsd.Shutdown() }()
+
+	conf := testConfig()
+	conf.NATSAddress = fmt.Sprintf("nats://127.0.0.1:%d", port)
+	conf.ListenerBatchBytes = 64 * 1024
+	conf.ListenerNATSBufferMB = 1
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	post := func() *http.Response {
+		resp, err := http.Post(url, "text/plain", bytes.NewBufferString(strings.Repeat(poetry[0], 1000)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusNoContent, post().StatusCode)
+
+	gnatsd.Shutdown()
+	waitFor(t, listener.nc.IsReconnecting)
+
+	// Writes are accepted while the NATS client can buffer them.
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		resp = post()
+		if resp.StatusCode != http.StatusNoContent {
+			break
+		}
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, 1, listener.stats.Get(natsUnavailable))
+
+	// Writes are accepted again once NATS is back.
+	gnatsd = spouttest.RunGnatsd(port)
+	waitFor(t, listener.nc.IsConnected)
+	assert.Equal(t, http.StatusNoContent, post().StatusCode)
+}
+
+func TestHTTPListenerJSON(t *testing.T) {
+	listener, err := StartHTTPListener(testConfig())
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
 	defer listener.Stop()
 
 	listenerCh, unsubListener := subListener(t)
 	defer unsubListener()
 
-	// Keep sending to the listener until it emits a batch.
-	conn := dialListener(t)
-	defer conn.Close()
-	msg := make([]byte, 100)
-	timeout := time.After(spouttest.LongWait)
-	writeCount := 0
-loop:
-	for {
-		_, err := conn.Write(msg)
-		require.NoError(t, err)
-		writeCount++
+	url := fmt.Sprintf("http://localhost:%d/write/json", listenPort)
 
-		select {
-		case <-listenerCh:
-			break loop
-		case <-time.After(time.Microsecond):
-			// Send again
-		case <-timeout:
-			t.Fatal("no message seen")
+	// An array of points.
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(`[
+		{"measurement": "cpu", "tags": {"host": "web01"}, "fields": {"load": 0.5}, "time": 1500000000000000000},
+		{"measurement": "mem", "fields": {"free": 1024}, "time": 1500000000000000000}
+	]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, "cpu,host=web01 load=0.5 1500000000000000000\n"+
+		"mem free=1024 1500000000000000000\n")
+
+	// Newline delimited points, with invalid points reported
+	// individually.
+	resp, err = http.Post(url+"?precision=s", "application/json", bytes.NewBufferString(
+		`{"measurement": "cpu", "fields": {"load": 1}, "time": 1500000000}
+{"fields": {"load": 2}}
+{"measurement": "cpu", "fields": {"load": "high"}, "time": 1500000001}
+{"measurement": "cpu", "fields": {"load": null}}
+`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var body struct {
+		Error  string
+		Errors []struct {
+			Index int
+			Error string
 		}
 	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "2 of 4 points could not be converted", body.Error)
+	require.Len(t, body.Errors, 2)
+	assert.Equal(t, 1, body.Errors[0].Index)
+	assert.Equal(t, "missing measurement", body.Errors[0].Error)
+	assert.Equal(t, 3, body.Errors[1].Index)
+	assert.Equal(t, `invalid value for field "load"`, body.Errors[1].Error)
+	assertBatch(t, listenerCh, "cpu load=1 1500000000000000000\n"+
+		`cpu load="high" 1500000001000000000`+"\n")
 
-	assertNoMore(t, listenerCh)
+	// Invalid JSON is rejected outright.
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(`[{"measurement": "cpu"`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertErrorBody(t, resp, "invalid JSON: unexpected EOF")
 
-	// Ensure that batch was output because batch size limit was
-	// reached, not the message count.
-	assert.True(t, writeCount < conf.BatchMessages,
-		fmt.Sprintf("writeCount = %d", writeCount))
+	assertNoMore(t, listenerCh)
 }
 
-func TestHTTPListener(t *testing.T) {
+func TestHTTPListenerPrometheus(t *testing.T) {
 	listener, err := StartHTTPListener(testConfig())
 	require.NoError(t, err)
 	assertListenerStarted(t, listener)
@@ -192,19 +1625,62 @@ func TestHTTPListener(t *testing.T) {
 	monitorCh, unsubMonitor := subMonitor(t)
 	defer unsubMonitor()
 
-	// Send some lines to the listener.
+	msg := encodePromWrite(
+		testSeries{
+			labels: []string{"__name__", "cpu_seconds", "job", "node"},
+			samples: []promSample{
+				{value: 1.5, timestamp: 1500000000000},
+				{value: math.NaN(), timestamp: 1500000001000},
+			},
+		},
+		testSeries{
+			labels:  []string{"__name__", "up"},
+			samples: []promSample{{value: 1, timestamp: 1500000000000}},
+		},
+	)
+	resp := postProm(t, snappyEncodeLiteral(msg))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh,
+		"cpu_seconds,job=node value=1.5 1500000000000000000\n"+
+			"up value=1 1500000000000000000\n")
+
+	// Invalid snappy data.
+	resp = postProm(t, msg)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Invalid protobuf message.
+	resp = postProm(t, snappyEncodeLiteral([]byte{0x0a, 0x05}))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	assertNoMore(t, listenerCh)
+	assertMonitorLine(t, monitorCh,
+		"spout_stat_listener,listener=testlistener "+
+			"received=1,sent=1,read_errors=1,decompress_errors=1,auth_failures=0,accepted=0,rejected=1,nats_unavailable=0\n")
+}
+
+func TestHTTPListenerBatchMaxAge(t *testing.T) {
+	conf := testConfig()
+	conf.BatchMessages = 99999
+	conf.ListenerBatchMaxMS = 200
+
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
 	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
-	for _, line := range poetry {
+	start := time.Now()
+	for _, line := range poetry[:2] {
 		_, err := http.Post(url, "text/plain", bytes.NewBufferString(line))
 		require.NoError(t, err)
 	}
 
-	for i := 0; i < numLines; i++ {
-		assertBatch(t, listenerCh, poetry[i])
-	}
+	assertBatch(t, listenerCh, poetry[0]+poetry[1])
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "batch sent too early")
 	assertNoMore(t, listenerCh)
-
-	assertMonitor(t, monitorCh, numLines, numLines)
 }
 
 func BenchmarkListenerLatency(b *testing.B) {
@@ -225,6 +1701,215 @@ func BenchmarkListenerLatency(b *testing.B) {
 	b.StopTimer()
 }
 
+// BenchmarkUDPListenerThroughput measures the whole UDP listener.
+// With sockets=1 the listener reads one datagram per system call. With
+// more sockets, each socket uses the batched reader (see
+// BenchmarkUDPReader).
+//
+// The senders are paced so that no datagrams are dropped: ns/op is
+// the time taken for the listener to receive each datagram, not the
+// time taken to send it.
+func BenchmarkUDPListenerThroughput(b *testing.B) {
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			benchmarkUDPListenerThroughput(b, sockets)
+		})
+	}
+}
+
+func benchmarkUDPListenerThroughput(b *testing.B, sockets int) {
+	const senders = 8
+
+	// The maximum number of datagrams which have been sent but not
+	// yet received. This is small enough to fit in the socket
+	// buffers.
+	const window = 256
+
+	conf := testConfig()
+	conf.ListenerUDPSockets = sockets
+	conf.BatchMessages = 1000
+	conf.ReadBufferBytes = 16 * 1024 * 1024
+	listener := startListener(b, conf)
+	defer listener.Stop()
+
+	line := []byte("cpu,host=host01,region=eu-west usage_user=12.5,usage_system=3.25 1500000000000000000\n")
+	conns := make([]*net.UDPConn, senders)
+	for i := range conns {
+		conns[i] = dialListener(b)
+		defer conns[i].Close()
+	}
+
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+
+	var sent int64
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		count := b.N / senders
+		if i == 0 {
+			count += b.N % senders
+		}
+		wg.Add(1)
+		go func(conn *net.UDPConn, count int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				n := atomic.AddInt64(&sent, 1)
+				for n-int64(listener.stats.Get(linesReceived)) > window {
+					// Sleep rather than spin so that the listener
+					// can run even with a single CPU.
+					time.Sleep(10 * time.Microsecond)
+				}
+				conn.Write(line)
+			}
+		}(conn, count)
+	}
+	wg.Wait()
+
+	// Wait for the listener to receive the last datagrams. Any
+	// dropped datagrams would make the result meaningless.
+	last := -1
+	for {
+		received := listener.stats.Get(linesReceived)
+		if received >= b.N {
+			break
+		}
+		if received == last {
+			b.Fatalf("%d of %d datagrams dropped", b.N-received, b.N)
+		}
+		last = received
+		time.Sleep(100 * time.Millisecond)
+	}
+	b.StopTimer()
+}
+
+// BenchmarkUDPReader compares reading datagrams from a single socket
+// one at a time with reading them using the batched (recvmmsg) reader
+// used by the multi-socket UDP listener.
+func BenchmarkUDPReader(b *testing.B) {
+	b.Run("read", func(b *testing.B) {
+		benchmarkUDPReader(b, func(sc *net.UDPConn) func() (int, error) {
+			buf := make([]byte, udpMaxDatagramSize)
+			return func() (int, error) {
+				_, _, err := sc.ReadFromUDP(buf)
+				return 1, err
+			}
+		})
+	})
+	b.Run("batched", func(b *testing.B) {
+		benchmarkUDPReader(b, func(sc *net.UDPConn) func() (int, error) {
+			r, err := newMmsgReader(sc, udpReadBatch)
+			require.NoError(b, err)
+			return func() (int, error) {
+				datagrams, err := r.Read()
+				return len(datagrams), err
+			}
+		})
+	})
+}
+
+// benchmarkUDPReader measures the time taken to read each datagram
+// from a socket. The datagrams are queued on the socket before the
+// timer is started so that only reading them is measured. newRead
+// returns a function which reads one or more datagrams from the
+// socket, returning the number read.
+func benchmarkUDPReader(b *testing.B, newRead func(*net.UDPConn) func() (int, error)) {
+	// Small enough to fit in the default socket receive buffer.
+	const chunk = 128
+
+	sc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(b, err)
+	defer sc.Close()
+	read := newRead(sc)
+
+	conn, err := net.DialUDP("udp", nil, sc.LocalAddr().(*net.UDPAddr))
+	require.NoError(b, err)
+	defer conn.Close()
+
+	line := []byte("cpu,host=host01,region=eu-west usage_user=12.5,usage_system=3.25 1500000000000000000\n")
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	for received := 0; received < b.N; {
+		b.StopTimer()
+		n := chunk
+		if b.N-received < n {
+			n = b.N - received
+		}
+		for i := 0; i < n; i++ {
+			_, err := conn.Write(line)
+			require.NoError(b, err)
+		}
+		sc.SetReadDeadline(time.Now().Add(spouttest.LongWait))
+		b.StartTimer()
+
+		for n > 0 {
+			count, err := read()
+			require.NoError(b, err)
+			n -= count
+			received += count
+		}
+	}
+}
+
+func postEncoded(t *testing.T, encoding string, body io.Reader) *http.Response {
+	url := fmt.Sprintf("http://localhost:%d/write", listenPort)
+	req, err := http.NewRequest("POST", url, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", encoding)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+// waitFor waits until cond returns true, failing the test if that
+// doesn't happen in time.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(spouttest.LongWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func postProm(t *testing.T, body []byte) *http.Response {
+	url := fmt.Sprintf("http://localhost:%d/api/v1/prom/write", listenPort)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func assertErrorBody(t *testing.T, resp *http.Response, expected string) {
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var body struct {
+		Error string `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, expected, body.Error)
+}
+
+// slowReader returns at most 7 bytes per read, pausing before each
+// read. When used as a HTTP request body, this causes the body to be
+// sent in many small pieces.
+type slowReader struct {
+	r io.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return r.r.Read(p)
+}
+
 func startListener(t require.TestingT, conf *config.Config) *Listener {
 	listener, err := StartListener(conf)
 	require.NoError(t, err)
@@ -232,6 +1917,39 @@ func startListener(t require.TestingT, conf *config.Config) *Listener {
 	return listener
 }
 
+func startTCPListener(t require.TestingT, conf *config.Config) *Listener {
+	listener, err := StartTCPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	return listener
+}
+
+func startUnixListener(t require.TestingT, conf *config.Config) *Listener {
+	listener, err := StartUnixListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	return listener
+}
+
+func assertDirContents(t *testing.T, dir string, expected ...string) {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.Equal(t, expected, names)
+}
+
+func unixTestConfig(t require.TestingT, socketType string) (*config.Config, func()) {
+	dir, err := ioutil.TempDir("", "listener-unix")
+	require.NoError(t, err)
+	conf := testConfig()
+	conf.ListenerSocketPath = filepath.Join(dir, "spout.sock")
+	conf.ListenerSocketType = socketType
+	return conf, func() { os.RemoveAll(dir) }
+}
+
 func assertListenerStarted(t require.TestingT, listener *Listener) {
 	select {
 	case <-listener.Ready():
@@ -252,6 +1970,37 @@ func dialListener(t require.TestingT) *net.UDPConn {
 	return conn
 }
 
+// dialTCPListener creates a TCP connection to the listener's inbound port.
+func dialTCPListener(t require.TestingT) *net.TCPConn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", listenPort))
+	require.NoError(t, err)
+	return conn.(*net.TCPConn)
+}
+
+func assertClosedByListener(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(spouttest.LongWait))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// waitForNoConns waits for the listener to stop tracking any stream
+// connections.
+func waitForNoConns(t *testing.T, listener *Listener) {
+	deadline := time.Now().Add(spouttest.LongWait)
+	for {
+		listener.connsMu.Lock()
+		n := len(listener.conns)
+		listener.connsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still open", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func subListener(t require.TestingT) (chan string, func()) {
 	return subscribe(t, natsSubject)
 }
@@ -286,6 +2035,26 @@ func assertBatch(t *testing.T, ch chan string, expected string) {
 	}
 }
 
+func assertBatchPrefix(t *testing.T, ch chan string, prefix string) string {
+	select {
+	case received := <-ch:
+		assert.True(t, strings.HasPrefix(received, prefix), "unexpected batch: %q", received)
+		return received
+	case <-time.After(spouttest.LongWait):
+		t.Fatal("failed to see message")
+	}
+	return ""
+}
+
+func assertBatchMatches(t *testing.T, ch chan string, pattern string) {
+	select {
+	case received := <-ch:
+		assert.Regexp(t, pattern, received)
+	case <-time.After(spouttest.LongWait):
+		t.Fatal("failed to see message")
+	}
+}
+
 func assertNoMore(t *testing.T, ch chan string) {
 	select {
 	case <-ch:
@@ -296,8 +2065,21 @@ func assertNoMore(t *testing.T, ch chan string) {
 
 func assertMonitor(t *testing.T, monitorCh chan string, received, sent int) {
 	expected := fmt.Sprintf(
-		"spout_stat_listener,listener=testlistener received=%d,sent=%d,read_errors=0\n",
+		"spout_stat_listener,listener=testlistener received=%d,sent=%d,read_errors=0,decompress_errors=0,auth_failures=0,accepted=0,rejected=0,nats_unavailable=0\n",
 		received, sent)
+	assertMonitorLine(t, monitorCh, expected)
+}
+
+func assertConnMonitor(t *testing.T, monitorCh chan string, conn net.Conn, lines, bytes int) {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+	expected := fmt.Sprintf(
+		"spout_stat_listener_conn,listener=testlistener,remote=%s lines=%d,bytes=%d\n",
+		host, lines, bytes)
+	assertMonitorLine(t, monitorCh, expected)
+}
+
+func assertMonitorLine(t *testing.T, monitorCh chan string, expected string) {
 	var line string
 	timeout := time.After(spouttest.LongWait)
 	for {
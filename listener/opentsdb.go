@@ -0,0 +1,472 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+// openTSDBMaxSeconds is the largest OpenTSDB timestamp which is taken
+// to be in seconds. Larger timestamps are in milliseconds.
+const openTSDBMaxSeconds = 0xffffffff
+
+// openTSDBVersion is the reply to the telnet style version command.
+// tcollector sends the command to check that its connection is still
+// alive and reconnects if there is no reply.
+const openTSDBVersion = "influx-spout OpenTSDB listener\n"
+
+var (
+	errOpenTSDBCommand   = errors.New("unsupported command")
+	errOpenTSDBFormat    = errors.New("expected put <metric> <timestamp> <value> [<tagk=tagv> ...]")
+	errOpenTSDBMetric    = errors.New("missing metric name")
+	errOpenTSDBValue     = errors.New("invalid value")
+	errOpenTSDBTimestamp = errors.New("invalid timestamp")
+	errOpenTSDBTag       = errors.New("invalid tag")
+)
+
+// StartOpenTSDBListener initialises a listener which accepts OpenTSDB
+// datapoints, either as telnet style "put" commands over TCP or as
+// JSON documents POSTed to the /api/put HTTP endpoint. As for
+// OpenTSDB, both are served on the same port. Datapoints are
+// converted to InfluxDB line protocol before being batched. It starts
+// the listener and its statistician and never returns.
+func StartOpenTSDBListener(c *config.Config) (_ *Listener, err error) {
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			listener.Stop()
+		}
+	}()
+
+	ln, err := listener.setupTCP()
+	if err != nil {
+		return nil, err
+	}
+	listener.openTSDB = true
+	listener.httpConns = newConnListener(ln.Addr())
+	server := listener.setupOpenTSDBHTTP()
+
+	listener.wg.Add(4)
+	go listener.startStatistician()
+	go listener.startBatchFlusher()
+	go listener.listenStream(ln)
+	go listener.serveConns(server)
+
+	log.Printf("OpenTSDB listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+func (l *Listener) setupOpenTSDBHTTP() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/put", l.handleOpenTSDBPut)
+	return &http.Server{Handler: mux}
+}
+
+// serveConns serves HTTP requests on the connections passed to the
+// httpConns listener until the listener is stopped.
+func (l *Listener) serveConns(server *http.Server) {
+	defer l.wg.Done()
+
+	go func() {
+		err := server.Serve(l.httpConns)
+		if err == nil || err == http.ErrServerClosed {
+			return
+		}
+		log.Fatal(err)
+	}()
+
+	<-l.stop
+	server.Close()
+}
+
+// routeConn passes a newly accepted connection to either the HTTP
+// server or the line based connection handler. Like OpenTSDB, HTTP
+// requests are recognised by their (upper case) first byte, which
+// telnet style commands never start with.
+//
+// The connection has already been counted against
+// listener_max_connections (see acceptConn). HTTP connections stay
+// counted until the HTTP server closes them.
+func (l *Listener) routeConn(conn net.Conn, tc *streamConn) {
+	r := bufio.NewReader(conn)
+	first, ok := l.peekFirstByte(conn, r, tc)
+	bc := &bufferedConn{Conn: conn, r: r}
+	switch {
+	case !ok:
+		conn.Close()
+		l.removeConn(tc)
+		l.wg.Done()
+	case first >= 'A' && first <= 'Z':
+		bc.onClose = func() { l.removeConn(tc) }
+		l.httpConns.deliver(bc)
+		l.wg.Done()
+	default:
+		l.handleConn(bc, tc)
+	}
+}
+
+// peekFirstByte waits for the first byte from a connection without
+// consuming it. It gives up if the connection is closed, is idle for
+// longer than listener_idle_timeout_secs or the listener is stopped.
+func (l *Listener) peekFirstByte(conn net.Conn, r *bufio.Reader, tc *streamConn) (byte, bool) {
+	idleTimeout := time.Duration(l.c.ListenerIdleTimeoutSecs) * time.Second
+	accepted := time.Now()
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		first, err := r.Peek(1)
+		if err == nil {
+			conn.SetReadDeadline(time.Time{})
+			return first[0], true
+		} else if !isTimeout(err) {
+			return 0, false
+		}
+
+		if idleTimeout > 0 && time.Since(accepted) > idleTimeout {
+			if l.c.Debug {
+				log.Printf("closing idle connection from %s", tc.remote)
+			}
+			return 0, false
+		}
+
+		select {
+		case <-l.stop:
+			return 0, false
+		default:
+		}
+	}
+}
+
+// bufferedConn is a net.Conn whose reads come from a bufio.Reader
+// wrapping the connection, so that bytes which have been peeked at
+// aren't lost. onClose, if set, is called the first time the
+// connection is closed.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) Close() error {
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return err
+}
+
+// connListener is a net.Listener which returns connections that have
+// already been accepted elsewhere.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// deliver passes a connection to Accept. The connection is closed if
+// the listener has been closed.
+func (c *connListener) deliver(conn net.Conn) {
+	select {
+	case c.conns <- conn:
+	case <-c.closed:
+		conn.Close()
+	}
+}
+
+func (c *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (c *connListener) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *connListener) Addr() net.Addr {
+	return c.addr
+}
+
+// convertOpenTSDB appends the line protocol equivalent of each
+// OpenTSDB put command in lines to dst. The version command is
+// answered on conn and the stats and help commands are ignored. Other
+// lines which can't be converted are dropped and counted as rejected.
+func (l *Listener) convertOpenTSDB(dst, lines []byte, conn net.Conn) []byte {
+	for len(lines) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(lines, '\n'); i == -1 {
+			line, lines = lines, nil
+		} else {
+			line, lines = lines[:i+1], lines[i+1:]
+		}
+		if isBlankOrComment(line) {
+			continue
+		}
+
+		switch string(openTSDBCommand(line)) {
+		case "version":
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := io.WriteString(conn, openTSDBVersion); err != nil && l.c.Debug {
+				log.Printf("OpenTSDB listener: failed to reply to version: %v", err)
+			}
+			continue
+		case "stats", "help":
+			continue
+		}
+
+		var err error
+		dst, err = convertOpenTSDBPut(dst, line)
+		if err != nil {
+			l.stats.Inc(linesRejected)
+			if l.c.Debug {
+				log.Printf("OpenTSDB listener: %v", parseError(line, err))
+			}
+		}
+	}
+	return dst
+}
+
+// openTSDBCommand returns the first word of a telnet style command.
+func openTSDBCommand(line []byte) []byte {
+	line = bytes.TrimLeft(line, " \t")
+	if i := bytes.IndexAny(line, " \t\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+// convertOpenTSDBPut converts a telnet style put command to line
+// protocol, appending it to dst. dst is returned unchanged if the
+// command can't be converted.
+func convertOpenTSDBPut(dst, line []byte) ([]byte, error) {
+	parts := bytes.Fields(line)
+	if len(parts) == 0 || string(parts[0]) != "put" {
+		return dst, errOpenTSDBCommand
+	}
+	if len(parts) < 4 {
+		return dst, errOpenTSDBFormat
+	}
+
+	timestamp, err := strconv.ParseInt(string(parts[2]), 10, 64)
+	if err != nil {
+		return dst, errOpenTSDBTimestamp
+	}
+	tags := make([]openTSDBTag, 0, len(parts)-4)
+	for _, part := range parts[4:] {
+		i := bytes.IndexByte(part, '=')
+		if i == -1 {
+			return dst, errOpenTSDBTag
+		}
+		tags = append(tags, openTSDBTag{string(part[:i]), string(part[i+1:])})
+	}
+
+	return appendOpenTSDB(dst, string(parts[1]), timestamp, string(parts[3]), tags)
+}
+
+type openTSDBTag struct {
+	key, value string
+}
+
+// appendOpenTSDB appends a datapoint to dst in line protocol. The
+// metric name is used as the measurement, the tags are sorted by key
+// and the value is stored in a field called "value". Timestamps are
+// in seconds, or milliseconds if they're too large to be seconds.
+func appendOpenTSDB(dst []byte, metric string, timestamp int64, value string, tags []openTSDBTag) ([]byte, error) {
+	if metric == "" {
+		return dst, errOpenTSDBMetric
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return dst, errOpenTSDBValue
+	}
+	switch {
+	case timestamp <= 0 || timestamp > math.MaxInt64/int64(time.Millisecond):
+		return dst, errOpenTSDBTimestamp
+	case timestamp > openTSDBMaxSeconds:
+		timestamp *= int64(time.Millisecond)
+	default:
+		timestamp *= int64(time.Second)
+	}
+	for _, tag := range tags {
+		if tag.key == "" || tag.value == "" {
+			return dst, errOpenTSDBTag
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].key < tags[j].key })
+
+	dst = lineformatter.Escape(dst, metric, lineformatter.MeasurementSpecial)
+	for _, tag := range tags {
+		dst = append(dst, ',')
+		dst = lineformatter.Escape(dst, tag.key, lineformatter.KeySpecial)
+		dst = append(dst, '=')
+		dst = lineformatter.Escape(dst, tag.value, lineformatter.KeySpecial)
+	}
+	dst = append(dst, " value="...)
+	dst = strconv.AppendFloat(dst, v, 'f', -1, 64)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, timestamp, 10)
+	return append(dst, '\n'), nil
+}
+
+// openTSDBPoint is a datapoint sent to the /api/put endpoint.
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     openTSDBValue     `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBValue holds the value of a datapoint, which may be either a
+// JSON number or a string. It is checked when it's converted.
+type openTSDBValue string
+
+func (v *openTSDBValue) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	*v = openTSDBValue(b)
+	return nil
+}
+
+// handleOpenTSDBPut processes an /api/put request. The body holds a
+// single datapoint or an array of datapoints in JSON. As for /write,
+// invalid datapoints are dropped but the rest of the request is
+// accepted, and a 400 response describing the first invalid
+// datapoint is returned in this case.
+func (l *Listener) handleOpenTSDBPut(w http.ResponseWriter, r *http.Request) {
+	write, ok := l.startHTTPWrite(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		l.stats.Inc(decompressErrors)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+	if l.maxBodyBytes > 0 {
+		body = newLimitReader(body, l.maxBodyBytes)
+	}
+
+	points, err := decodeOpenTSDBPoints(body)
+	if err == errBodyTooLarge {
+		l.stats.Inc(readErrors)
+		httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		l.stats.Inc(readErrors)
+		httpError(w, fmt.Sprintf("invalid datapoints: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var lines []byte
+	var firstErr error
+	for i, point := range points {
+		tags := make([]openTSDBTag, 0, len(point.Tags))
+		for k, v := range point.Tags {
+			tags = append(tags, openTSDBTag{k, v})
+		}
+		lines, err = appendOpenTSDB(lines, point.Metric, point.Timestamp, string(point.Value), tags)
+		if err != nil {
+			l.stats.Inc(linesRejected)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("datapoint %d: %v", i, err)
+			}
+		}
+	}
+
+	if l.c.ListenerValidate {
+		lines = l.validateLines(lines)
+	}
+	l.limiter.Take(write.source, countLines(lines))
+	l.appendBatch(write.batch, lines)
+
+	if firstErr != nil {
+		httpError(w, firstErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeOpenTSDBPoints decodes a single JSON datapoint or an array of
+// datapoints.
+func decodeOpenTSDBPoints(r io.Reader) ([]openTSDBPoint, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+
+	dec := json.NewDecoder(br)
+	var points []openTSDBPoint
+	if b, _ := br.Peek(1); b[0] == '[' {
+		err := dec.Decode(&points)
+		return points, err
+	}
+	var point openTSDBPoint
+	err := dec.Decode(&point)
+	return append(points, point), err
+}
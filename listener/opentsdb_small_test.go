@@ -0,0 +1,115 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertOpenTSDBPut(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{
+			"put sys.cpu.user 1500000000 42.5 host=web01 cpu=0\n",
+			"sys.cpu.user,cpu=0,host=web01 value=42.5 1500000000000000000\n",
+		},
+		{
+			"put sys.cpu.user 1500000000123 1",
+			"sys.cpu.user value=1 1500000000123000000\n",
+		},
+		{
+			"put  sys.load\t1500000000  -3e2   dc=eu  \r\n",
+			"sys.load,dc=eu value=-300 1500000000000000000\n",
+		},
+		{
+			"put my,metric 1 1 a=b=c d,e=f\n",
+			`my\,metric,a=b\=c,d\,e=f value=1 1000000000` + "\n",
+		},
+	}
+	for _, test := range tests {
+		actual, err := convertOpenTSDBPut(nil, []byte(test.line))
+		require.NoError(t, err, test.line)
+		assert.Equal(t, test.expected, string(actual), test.line)
+	}
+}
+
+func TestConvertOpenTSDBPutErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"version", errOpenTSDBCommand},
+		{"PUT foo 1 1", errOpenTSDBCommand},
+		{"put foo 1", errOpenTSDBFormat},
+		{"put foo x 1", errOpenTSDBTimestamp},
+		{"put foo 0 1", errOpenTSDBTimestamp},
+		{"put foo -1 1", errOpenTSDBTimestamp},
+		{"put foo 99999999999999999 1", errOpenTSDBTimestamp},
+		{"put foo 1 x", errOpenTSDBValue},
+		{"put foo 1 NaN", errOpenTSDBValue},
+		{"put foo 1 1 host", errOpenTSDBTag},
+		{"put foo 1 1 =web01", errOpenTSDBTag},
+		{"put foo 1 1 host=", errOpenTSDBTag},
+	}
+	for _, test := range tests {
+		dst, err := convertOpenTSDBPut([]byte("keep\n"), []byte(test.line))
+		assert.Equal(t, test.err, err, test.line)
+		assert.Equal(t, "keep\n", string(dst), test.line)
+	}
+}
+
+func TestOpenTSDBCommand(t *testing.T) {
+	check := func(line, expected string) {
+		assert.Equal(t, expected, string(openTSDBCommand([]byte(line))), line)
+	}
+	check("version\n", "version")
+	check("  stats\r\n", "stats")
+	check("put foo 1 1", "put")
+	check("\thelp", "help")
+	check("", "")
+}
+
+func TestDecodeOpenTSDBPoints(t *testing.T) {
+	points, err := decodeOpenTSDBPoints(bytes.NewBufferString(
+		`{"metric": "sys.cpu", "timestamp": 1500000000, "value": 1.5, "tags": {"host": "web01"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, []openTSDBPoint{
+		{Metric: "sys.cpu", Timestamp: 1500000000, Value: "1.5", Tags: map[string]string{"host": "web01"}},
+	}, points)
+
+	points, err = decodeOpenTSDBPoints(bytes.NewBufferString(`
+		[
+			{"metric": "a", "timestamp": 1, "value": 1},
+			{"metric": "b", "timestamp": 2, "value": "2"}
+		]`))
+	require.NoError(t, err)
+	assert.Equal(t, []openTSDBPoint{
+		{Metric: "a", Timestamp: 1, Value: "1"},
+		{Metric: "b", Timestamp: 2, Value: "2"},
+	}, points)
+
+	_, err = decodeOpenTSDBPoints(bytes.NewBufferString(""))
+	assert.Error(t, err)
+	_, err = decodeOpenTSDBPoints(bytes.NewBufferString(`{"metric": `))
+	assert.Error(t, err)
+}
@@ -0,0 +1,304 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+// promMetricNameLabel is the label holding a Prometheus metric's name.
+const promMetricNameLabel = "__name__"
+
+var (
+	errProtobufTruncated = errors.New("truncated protobuf message")
+	errProtobufWireType  = errors.New("unsupported protobuf wire type")
+	errPromMetricName    = errors.New("no metric name")
+	errPromValue         = errors.New("invalid value")
+)
+
+// Sample timestamps are in milliseconds. These are the limits for
+// timestamps which can be converted to nanoseconds.
+const (
+	maxPromTimestamp = math.MaxInt64 / int64(1e6)
+	minPromTimestamp = math.MinInt64 / int64(1e6)
+)
+
+// handlePromWrite processes a Prometheus remote_write request. The
+// request body is a snappy compressed WriteRequest protobuf message.
+// Each sample is converted to a line in the same way as InfluxDB does:
+// the metric name is the measurement, the other labels are tags and
+// the sample value is stored in a field called "value".
+//
+// Samples which can't be represented in line protocol (NaN or
+// infinite values, timestamps out of range, or series without a
+// metric name) are dropped and counted as rejected.
+func (l *Listener) handlePromWrite(w http.ResponseWriter, r *http.Request) {
+	write, ok := l.startHTTPWrite(w, r)
+	if !ok {
+		return
+	}
+
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		l.stats.Inc(decompressErrors)
+		httpError(w, fmt.Sprintf("unsupported Content-Encoding: %q", encoding),
+			http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if l.maxBodyBytes > 0 {
+		body = newLimitReader(r.Body, l.maxBodyBytes)
+	}
+	compressed, err := ioutil.ReadAll(body)
+	if err == errBodyTooLarge {
+		l.stats.Inc(readErrors)
+		httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		l.stats.Inc(readErrors)
+		httpError(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappyDecode(compressed, l.maxBodyBytes)
+	if err == errSnappyTooLarge {
+		l.stats.Inc(readErrors)
+		httpError(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		l.stats.Inc(decompressErrors)
+		httpError(w, fmt.Sprintf("failed to decompress body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	lines, err := promToLines(nil, data, func(reason error) {
+		l.stats.Inc(linesRejected)
+		if l.c.Debug {
+			log.Printf("Prometheus write from %s: dropped sample: %v", r.RemoteAddr, reason)
+		}
+	})
+	if err != nil {
+		l.stats.Inc(readErrors)
+		httpError(w, fmt.Sprintf("invalid write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if l.c.ListenerValidate {
+		lines = l.validateLines(lines)
+	}
+	l.limiter.Take(write.source, countLines(lines))
+	l.appendBatch(write.batch, lines)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promToLines converts a WriteRequest protobuf message to line
+// protocol, appending the lines to dst. reject is called with the
+// reason for each sample which couldn't be converted.
+//
+// The relevant parts of the message definitions are:
+//
+//     message WriteRequest {
+//       repeated TimeSeries timeseries = 1;
+//     }
+//     message TimeSeries {
+//       repeated Label labels = 1;
+//       repeated Sample samples = 2;
+//     }
+//     message Label {
+//       string name = 1;
+//       string value = 2;
+//     }
+//     message Sample {
+//       double value = 1;
+//       int64 timestamp = 2; // milliseconds
+//     }
+func promToLines(dst, msg []byte, reject func(error)) ([]byte, error) {
+	var series promSeries
+	err := walkProtobuf(msg, func(field int, data []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		if err := series.parse(data); err != nil {
+			return err
+		}
+		dst = series.appendLines(dst, reject)
+		return nil
+	})
+	return dst, err
+}
+
+type promLabel struct {
+	name, value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+// promSeries holds a single parsed TimeSeries message. It is reused
+// for each time series in a request.
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+func (s *promSeries) parse(msg []byte) error {
+	s.labels = s.labels[:0]
+	s.samples = s.samples[:0]
+	return walkProtobuf(msg, func(field int, data []byte, _ uint64) error {
+		switch field {
+		case 1:
+			var label promLabel
+			err := walkProtobuf(data, func(field int, data []byte, _ uint64) error {
+				switch field {
+				case 1:
+					label.name = string(data)
+				case 2:
+					label.value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.labels = append(s.labels, label)
+		case 2:
+			var sample promSample
+			err := walkProtobuf(data, func(field int, _ []byte, v uint64) error {
+				switch field {
+				case 1:
+					sample.value = math.Float64frombits(v)
+				case 2:
+					sample.timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.samples = append(s.samples, sample)
+		}
+		return nil
+	})
+}
+
+// appendLines appends a line for each of the time series' samples to
+// dst. reject is called for each sample which couldn't be converted.
+func (s *promSeries) appendLines(dst []byte, reject func(error)) []byte {
+	var name string
+	for _, label := range s.labels {
+		if label.name == promMetricNameLabel {
+			name = label.value
+		}
+	}
+	if name == "" {
+		for range s.samples {
+			reject(errPromMetricName)
+		}
+		return dst
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+
+	for _, sample := range s.samples {
+		if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			reject(errPromValue)
+			continue
+		}
+		if sample.timestamp > maxPromTimestamp || sample.timestamp < minPromTimestamp {
+			reject(errTimestampRange)
+			continue
+		}
+		dst = lineformatter.Escape(dst, name, lineformatter.MeasurementSpecial)
+		for _, label := range s.labels {
+			if label.name == promMetricNameLabel || label.value == "" {
+				continue
+			}
+			dst = append(dst, ',')
+			dst = lineformatter.Escape(dst, label.name, lineformatter.KeySpecial)
+			dst = append(dst, '=')
+			dst = lineformatter.Escape(dst, label.value, lineformatter.KeySpecial)
+		}
+		dst = append(dst, " value="...)
+		dst = strconv.AppendFloat(dst, sample.value, 'f', -1, 64)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, sample.timestamp*int64(1e6), 10)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// walkProtobuf calls fn for each field in a protobuf message. For
+// length-delimited fields, data holds the field's bytes. For other
+// fields, v holds the field's value (as raw bits for fixed size
+// fields).
+func walkProtobuf(msg []byte, fn func(field int, data []byte, v uint64) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errProtobufTruncated
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+
+		var data []byte
+		var v uint64
+		switch key & 0x07 {
+		case 0: // varint
+			v, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errProtobufTruncated
+			}
+			msg = msg[n:]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return errProtobufTruncated
+			}
+			v = binary.LittleEndian.Uint64(msg)
+			msg = msg[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errProtobufTruncated
+			}
+			data = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return errProtobufTruncated
+			}
+			v = uint64(binary.LittleEndian.Uint32(msg))
+			msg = msg[4:]
+		default:
+			return errProtobufWireType
+		}
+
+		if err := fn(field, data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
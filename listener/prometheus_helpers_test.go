@@ -0,0 +1,87 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small medium
+
+package listener
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// testSeries describes a time series for encodePromWrite. labels
+// holds alternating label names and values.
+type testSeries struct {
+	labels  []string
+	samples []promSample
+}
+
+// encodePromWrite encodes a Prometheus WriteRequest protobuf message.
+func encodePromWrite(series ...testSeries) []byte {
+	var msg []byte
+	for _, s := range series {
+		var ts []byte
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			var label []byte
+			label = appendProtoBytes(label, 1, []byte(s.labels[i]))
+			label = appendProtoBytes(label, 2, []byte(s.labels[i+1]))
+			ts = appendProtoBytes(ts, 1, label)
+		}
+		for _, sample := range s.samples {
+			var b []byte
+			b = appendProtoKey(b, 1, 1)
+			b = append(b, make([]byte, 8)...)
+			binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(sample.value))
+			b = appendProtoKey(b, 2, 0)
+			b = appendUvarint(b, uint64(sample.timestamp))
+			ts = appendProtoBytes(ts, 2, b)
+		}
+		msg = appendProtoBytes(msg, 1, ts)
+	}
+	return msg
+}
+
+func appendProtoKey(b []byte, field, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoKey(b, field, 2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// snappyEncodeLiteral encodes data in the snappy block format using
+// only literal elements (i.e. without any actual compression).
+func snappyEncodeLiteral(data []byte) []byte {
+	out := appendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		n := len(chunk) - 1
+		out = append(out, 61<<2, byte(n), byte(n>>8))
+		out = append(out, chunk...)
+		data = data[len(chunk):]
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromToLines(t *testing.T) {
+	msg := encodePromWrite(
+		testSeries{
+			labels: []string{"job", "node", "__name__", "cpu_seconds", "instance", "web01:9100"},
+			samples: []promSample{
+				{value: 1.5, timestamp: 1500000000000},
+				{value: -2, timestamp: 1500000001000},
+			},
+		},
+		testSeries{
+			labels:  []string{"__name__", "up"},
+			samples: []promSample{{value: 1, timestamp: 1500000000123}},
+		},
+	)
+
+	lines, rejected, err := convertProm([]byte("keep\n"), msg)
+	require.NoError(t, err)
+	assert.Empty(t, rejected)
+	assert.Equal(t, "keep\n"+
+		"cpu_seconds,instance=web01:9100,job=node value=1.5 1500000000000000000\n"+
+		"cpu_seconds,instance=web01:9100,job=node value=-2 1500000001000000000\n"+
+		"up value=1 1500000000123000000\n",
+		string(lines))
+}
+
+func TestPromToLinesEscaping(t *testing.T) {
+	msg := encodePromWrite(testSeries{
+		labels:  []string{"__name__", "my metric,x", "a=b", "c d,e", "empty", ""},
+		samples: []promSample{{value: 1e21, timestamp: 1}},
+	})
+
+	lines, rejected, err := convertProm(nil, msg)
+	require.NoError(t, err)
+	assert.Empty(t, rejected)
+	assert.Equal(t, `my\ metric\,x,a\=b=c\ d\,e value=1000000000000000000000 1000000`+"\n",
+		string(lines))
+}
+
+func TestPromToLinesRejected(t *testing.T) {
+	msg := encodePromWrite(
+		testSeries{
+			labels: []string{"__name__", "foo"},
+			samples: []promSample{
+				{value: math.NaN(), timestamp: 1},
+				{value: math.Inf(1), timestamp: 1},
+				{value: 2, timestamp: 1},
+				{value: 3, timestamp: maxPromTimestamp + 1},
+				{value: 4, timestamp: minPromTimestamp - 1},
+				{value: 5, timestamp: maxPromTimestamp},
+				{value: 6, timestamp: minPromTimestamp},
+			},
+		},
+		testSeries{
+			labels:  []string{"job", "no_name"},
+			samples: []promSample{{value: 1, timestamp: 1}, {value: 2, timestamp: 1}},
+		},
+	)
+
+	lines, rejected, err := convertProm(nil, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []error{
+		errPromValue, errPromValue, errTimestampRange, errTimestampRange,
+		errPromMetricName, errPromMetricName,
+	}, rejected)
+	assert.Equal(t, "foo value=2 1000000\n"+
+		"foo value=5 9223372036854000000\n"+
+		"foo value=6 -9223372036854000000\n",
+		string(lines))
+}
+
+func TestPromToLinesUnknownFields(t *testing.T) {
+	// Fields which aren't known are skipped, whatever their type.
+	msg := encodePromWrite(testSeries{
+		labels:  []string{"__name__", "foo"},
+		samples: []promSample{{value: 1, timestamp: 1}},
+	})
+	msg = appendProtoBytes(msg, 3, []byte("metadata"))
+	msg = appendProtoKey(msg, 4, 0)
+	msg = appendUvarint(msg, 300)
+	msg = appendProtoKey(msg, 5, 5)
+	msg = append(msg, 1, 2, 3, 4)
+
+	lines, _, err := convertProm(nil, msg)
+	require.NoError(t, err)
+	assert.Equal(t, "foo value=1 1000000\n", string(lines))
+}
+
+func TestPromToLinesErrors(t *testing.T) {
+	valid := encodePromWrite(testSeries{
+		labels:  []string{"__name__", "foo"},
+		samples: []promSample{{value: 1, timestamp: 1}},
+	})
+
+	tests := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{
+		{"truncated", valid[:len(valid)-1], errProtobufTruncated},
+		{"truncated key", []byte{0x80}, errProtobufTruncated},
+		{"truncated fixed64", []byte{0x09, 1, 2, 3}, errProtobufTruncated},
+		{"truncated fixed32", []byte{0x0d, 1, 2, 3}, errProtobufTruncated},
+		{"bad length", []byte{0x0a, 0x05, 0x00}, errProtobufTruncated},
+		{"group wire type", []byte{0x0b}, errProtobufWireType},
+		{"nested error", []byte{0x0a, 0x02, 0x0a, 0x05}, errProtobufTruncated},
+	}
+	for _, test := range tests {
+		_, _, err := convertProm(nil, test.msg)
+		assert.Equal(t, test.err, err, test.name)
+	}
+}
+
+// convertProm calls promToLines, also returning the reason for each
+// rejected sample.
+func convertProm(dst, msg []byte) ([]byte, []error, error) {
+	var rejected []error
+	lines, err := promToLines(dst, msg, func(reason error) {
+		rejected = append(rejected, reason)
+	})
+	return lines, rejected, err
+}
@@ -0,0 +1,324 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+// rateLimitIdle is how long a source must go unseen before its state
+// is discarded.
+const rateLimitIdle = 10 * time.Minute
+
+// newRateLimiter creates a rateLimiter from the configured rate
+// limits. nil is returned if no rate limits are configured, meaning
+// that no sources are limited.
+func newRateLimiter(limits []config.RateLimit) (*rateLimiter, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	rl := &rateLimiter{
+		ipSources:   make(map[[net.IPv6len]byte]*rateSource),
+		userSources: make(map[string]*rateSource),
+		now:         time.Now,
+	}
+	for i, limit := range limits {
+		rule, err := newRateRule(limit)
+		if err != nil {
+			return nil, fmt.Errorf("listener_rate_limit %d: %v", i+1, err)
+		}
+		rl.rules = append(rl.rules, rule)
+	}
+	return rl, nil
+}
+
+func newRateRule(limit config.RateLimit) (*rateRule, error) {
+	if (limit.CIDR == "") == (limit.User == "") {
+		return nil, errors.New("exactly one of cidr or user must be set")
+	}
+	if limit.LinesPerSec <= 0 {
+		return nil, errors.New("lines_per_sec must be greater than 0")
+	}
+
+	rule := &rateRule{
+		user:  limit.User,
+		rate:  float64(limit.LinesPerSec),
+		burst: float64(limit.Burst),
+	}
+	if rule.burst <= 0 {
+		rule.burst = rule.rate
+	}
+	if limit.CIDR != "" {
+		_, ipNet, err := net.ParseCIDR(limit.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		rule.ipNet = ipNet
+	}
+	return rule, nil
+}
+
+// rateRule is a single configured rate limit.
+type rateRule struct {
+	ipNet *net.IPNet // nil for user rules
+	user  string
+	rate  float64 // lines per second
+	burst float64
+}
+
+// rateLimiter applies token bucket rate limits to the lines received
+// from each source. A source is a remote IP address or (for the HTTP
+// listener) an authenticated user. Every source within a rule's CIDR
+// gets its own bucket.
+//
+// A datagram is dropped unless its sender's bucket holds a token for
+// each of its lines, or is full if the datagram has more lines than the
+// bucket can hold. HTTP requests are checked before the body is read
+// so they only need a single token, but every line read is then taken
+// from the bucket, possibly leaving it in debt. This means that HTTP
+// requests are either accepted or rejected in full while the
+// configured rate is still enforced over time.
+type rateLimiter struct {
+	rules []*rateRule
+	now   func() time.Time
+
+	mu          sync.Mutex
+	ipSources   map[[net.IPv6len]byte]*rateSource
+	userSources map[string]*rateSource
+}
+
+// rateSource tracks the bucket and stats for a single source.
+type rateSource struct {
+	name      string
+	rule      *rateRule // nil if the source isn't limited
+	tokens    float64
+	updated   time.Time
+	lines     int
+	throttled int
+}
+
+// IPSource returns the source for a remote IP address, or nil if the
+// address isn't rate limited. The most specific matching CIDR rule
+// applies.
+func (rl *rateLimiter) IPSource(ip net.IP) *rateSource {
+	ip16 := ip.To16()
+	if rl == nil || ip16 == nil {
+		return nil
+	}
+	var key [net.IPv6len]byte
+	copy(key[:], ip16)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	s, ok := rl.ipSources[key]
+	if !ok {
+		var best *rateRule
+		bestBits := -1
+		for _, rule := range rl.rules {
+			if rule.ipNet == nil || !rule.ipNet.Contains(ip) {
+				continue
+			}
+			if bits, _ := rule.ipNet.Mask.Size(); bits > bestBits {
+				best, bestBits = rule, bits
+			}
+		}
+		s = rl.newSource(ip.String(), best)
+		rl.ipSources[key] = s
+	}
+	s.updated = rl.touch(s)
+	return s.limited()
+}
+
+// UserSource returns the source for an authenticated user, or nil if
+// no rule applies to the user.
+func (rl *rateLimiter) UserSource(user string) *rateSource {
+	if rl == nil || user == "" {
+		return nil
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	s, ok := rl.userSources[user]
+	if !ok {
+		var match *rateRule
+		for _, rule := range rl.rules {
+			if rule.user == user {
+				match = rule
+				break
+			}
+		}
+		s = rl.newSource(user, match)
+		rl.userSources[user] = s
+	}
+	s.updated = rl.touch(s)
+	return s.limited()
+}
+
+func (rl *rateLimiter) newSource(name string, rule *rateRule) *rateSource {
+	s := &rateSource{name: name, rule: rule, updated: rl.now()}
+	if rule != nil {
+		s.tokens = rule.burst
+	}
+	return s
+}
+
+// touch refills a source's bucket for the time elapsed since it was
+// last updated and returns the current time. rl.mu must be held.
+func (rl *rateLimiter) touch(s *rateSource) time.Time {
+	now := rl.now()
+	if s.rule != nil {
+		s.tokens += now.Sub(s.updated).Seconds() * s.rule.rate
+		if s.tokens > s.rule.burst {
+			s.tokens = s.rule.burst
+		}
+	}
+	return now
+}
+
+func (s *rateSource) limited() *rateSource {
+	if s.rule == nil {
+		return nil
+	}
+	return s
+}
+
+// Allow takes n lines from a source's bucket, returning false (and
+// counting the source as throttled) if there aren't enough tokens. At
+// least one token is always required and no more than a full bucket.
+// A nil source is never throttled.
+func (rl *rateLimiter) Allow(s *rateSource, n int) bool {
+	if s == nil {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	s.updated = rl.touch(s)
+	need := math.Min(math.Max(float64(n), 1), s.rule.burst)
+	if s.tokens < need {
+		s.throttled++
+		return false
+	}
+	s.tokens -= float64(n)
+	s.lines += n
+	return true
+}
+
+// Take unconditionally takes n lines from a source's bucket. It is
+// used for the lines in an HTTP request which has already been
+// allowed.
+func (rl *rateLimiter) Take(s *rateSource, n int) {
+	if s == nil {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	s.updated = rl.touch(s)
+	s.tokens -= float64(n)
+	s.lines += n
+}
+
+// RetryAfter returns the number of seconds until a throttled source
+// will have a token again.
+func (rl *rateLimiter) RetryAfter(s *rateSource) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	secs := int(math.Ceil((1 - s.tokens) / s.rule.rate))
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
+
+// countLines returns the number of lines in a block of lines, for
+// the purposes of rate limiting. The final line doesn't need to be
+// newline terminated.
+func countLines(lines []byte) int {
+	n := bytes.Count(lines, []byte{'\n'})
+	if len(lines) > 0 && lines[len(lines)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// sourceIP returns the IP address of a datagram's sender, or nil if
+// it doesn't have one (e.g. for Unix datagram sockets).
+func sourceIP(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	return nil
+}
+
+var throttleStatsLine = lineformatter.New(
+	"spout_stat_listener_throttle",
+	[]string{"listener", "source"},
+	"lines",
+	"throttled",
+)
+
+// publishThrottleStats sends the stats for each rate limited source
+// which has been throttled to the monitor subject. Sources which
+// haven't been seen for a while are forgotten.
+func (l *Listener) publishThrottleStats(listenerName string) {
+	rl := l.limiter
+	if rl == nil {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	publish := func(s *rateSource) bool {
+		if now.Sub(s.updated) > rateLimitIdle {
+			return false
+		}
+		if s.throttled > 0 {
+			l.nc.Publish(l.c.NATSSubjectMonitor, throttleStatsLine.Format(
+				[]string{listenerName, s.name},
+				s.lines,
+				s.throttled,
+			))
+		}
+		return true
+	}
+	for key, s := range rl.ipSources {
+		if !publish(s) {
+			delete(rl.ipSources, key)
+		}
+	}
+	for key, s := range rl.userSources {
+		if !publish(s) {
+			delete(rl.userSources, key)
+		}
+	}
+}
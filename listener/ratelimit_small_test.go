@@ -0,0 +1,166 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+func TestRateLimiterNotConfigured(t *testing.T) {
+	rl, err := newRateLimiter(nil)
+	require.NoError(t, err)
+	assert.Nil(t, rl)
+
+	// A nil limiter never limits.
+	s := rl.IPSource(net.ParseIP("10.0.0.1"))
+	assert.Nil(t, s)
+	assert.Nil(t, rl.UserSource("alice"))
+	assert.True(t, rl.Allow(s, 1000))
+}
+
+func TestRateLimiterInvalid(t *testing.T) {
+	tests := []struct {
+		limit config.RateLimit
+		err   string
+	}{
+		{config.RateLimit{LinesPerSec: 1}, "exactly one of cidr or user must be set"},
+		{config.RateLimit{CIDR: "10.0.0.0/8", User: "alice", LinesPerSec: 1}, "exactly one of cidr or user must be set"},
+		{config.RateLimit{CIDR: "10.0.0.0/8"}, "lines_per_sec must be greater than 0"},
+		{config.RateLimit{CIDR: "10.0.0.0", LinesPerSec: 1}, "invalid CIDR address: 10.0.0.0"},
+	}
+	for _, test := range tests {
+		_, err := newRateLimiter([]config.RateLimit{
+			{User: "bob", LinesPerSec: 1},
+			test.limit,
+		})
+		assert.EqualError(t, err, "listener_rate_limit 2: "+test.err)
+	}
+}
+
+func TestRateLimiterMoreThanBurst(t *testing.T) {
+	rl, clock := newTestRateLimiter(t,
+		config.RateLimit{CIDR: "10.0.0.0/8", LinesPerSec: 10, Burst: 5},
+	)
+	s := rl.IPSource(net.ParseIP("10.0.0.1"))
+	require.NotNil(t, s)
+
+	// A full bucket is enough for any number of lines.
+	assert.True(t, rl.Allow(s, 8))
+
+	// The bucket must then be full again, not just hold the burst.
+	*clock = clock.Add(700 * time.Millisecond)
+	assert.False(t, rl.Allow(s, 8), "bucket not full")
+	assert.False(t, rl.Allow(s, 5), "bucket not full")
+	*clock = clock.Add(100 * time.Millisecond)
+	assert.True(t, rl.Allow(s, 8))
+	assert.Equal(t, 16, s.lines)
+	assert.Equal(t, 2, s.throttled)
+}
+
+func TestRateLimiterIP(t *testing.T) {
+	rl, clock := newTestRateLimiter(t,
+		config.RateLimit{CIDR: "10.0.0.0/8", LinesPerSec: 10},
+		config.RateLimit{CIDR: "10.1.0.0/16", LinesPerSec: 2, Burst: 5},
+	)
+
+	assert.Nil(t, rl.IPSource(net.ParseIP("192.168.0.1")), "unmatched address")
+	assert.Nil(t, rl.IPSource(nil), "no address")
+
+	// The burst defaults to the rate.
+	s := rl.IPSource(net.ParseIP("10.0.0.1"))
+	require.NotNil(t, s)
+	assert.True(t, rl.Allow(s, 6))
+	assert.False(t, rl.Allow(s, 6), "not enough tokens")
+	assert.True(t, rl.Allow(s, 4))
+	assert.False(t, rl.Allow(s, 1), "bucket empty")
+
+	// Each address has its own bucket.
+	other := rl.IPSource(net.ParseIP("10.0.0.2"))
+	assert.True(t, rl.Allow(other, 1))
+
+	// Tokens are replenished over time.
+	*clock = clock.Add(50 * time.Millisecond)
+	assert.False(t, rl.Allow(s, 1))
+	*clock = clock.Add(50 * time.Millisecond)
+	assert.True(t, rl.Allow(s, 1))
+
+	// More lines than the burst need a full bucket, leaving it in
+	// debt.
+	*clock = clock.Add(time.Second)
+	assert.True(t, rl.Allow(s, 15))
+	assert.False(t, rl.Allow(s, 1))
+	assert.Equal(t, 1, rl.RetryAfter(s))
+	assert.Equal(t, 26, s.lines)
+	assert.Equal(t, 4, s.throttled)
+
+	// The most specific rule applies.
+	s = rl.IPSource(net.ParseIP("10.1.2.3"))
+	assert.True(t, rl.Allow(s, 5))
+	assert.False(t, rl.Allow(s, 1))
+	assert.Equal(t, 1, rl.RetryAfter(s))
+	assert.Equal(t, "10.1.2.3", s.name)
+
+	// IPv4-mapped IPv6 addresses (as received by dual stack sockets)
+	// share the bucket of the IPv4 address.
+	assert.Equal(t, s, rl.IPSource(net.ParseIP("::ffff:10.1.2.3")))
+}
+
+func TestRateLimiterUser(t *testing.T) {
+	rl, clock := newTestRateLimiter(t,
+		config.RateLimit{User: "alice", LinesPerSec: 1},
+	)
+
+	assert.Nil(t, rl.UserSource(""))
+	assert.Nil(t, rl.UserSource("bob"))
+
+	s := rl.UserSource("alice")
+	require.NotNil(t, s)
+	assert.True(t, rl.Allow(s, 0))
+	rl.Take(s, 10)
+	assert.False(t, rl.Allow(s, 0))
+	assert.Equal(t, 10, rl.RetryAfter(s))
+
+	*clock = clock.Add(9 * time.Second)
+	assert.False(t, rl.Allow(s, 0), "bucket empty")
+	*clock = clock.Add(time.Second)
+	assert.True(t, rl.Allow(s, 0))
+}
+
+func TestCountLines(t *testing.T) {
+	assert.Equal(t, 0, countLines(nil))
+	assert.Equal(t, 1, countLines([]byte("foo x=1")))
+	assert.Equal(t, 1, countLines([]byte("foo x=1\n")))
+	assert.Equal(t, 2, countLines([]byte("foo x=1\nfoo x=2")))
+}
+
+// newTestRateLimiter creates a rateLimiter with a clock which is
+// controlled by the test.
+func newTestRateLimiter(t *testing.T, limits ...config.RateLimit) (*rateLimiter, *time.Time) {
+	rl, err := newRateLimiter(limits)
+	require.NoError(t, err)
+
+	clock := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return clock }
+	return rl, &clock
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errSnappyCorrupt  = errors.New("corrupt snappy data")
+	errSnappyTooLarge = errors.New("snappy data too large")
+)
+
+// snappyDecode decodes data in the snappy block format (as used by
+// Prometheus remote_write requests). It returns errSnappyTooLarge if
+// the decoded data would be longer than maxLen (if maxLen > 0).
+//
+// See https://github.com/google/snappy/blob/master/format_description.txt
+func snappyDecode(src []byte, maxLen int64) ([]byte, error) {
+	dLen, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errSnappyCorrupt
+	}
+	if maxLen > 0 && dLen > uint64(maxLen) {
+		return nil, errSnappyTooLarge
+	}
+	if dLen > uint64(len(src))*256 {
+		// Snappy can't compress data this well.
+		return nil, errSnappyCorrupt
+	}
+	src = src[n:]
+	dst := make([]byte, 0, dLen)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0x00: // literal
+			length = int(tag >> 2)
+			if length >= 60 {
+				// The length is in the following 1-4 bytes.
+				extra := length - 59
+				if len(src) < 1+extra {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra; i > 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			src = src[1:]
+			if length <= 0 || length > len(src) || len(dst)+length > cap(dst) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 0x01: // copy with a 1 byte offset
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 0x02: // copy with a 2 byte offset
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 0x03: // copy with a 4 byte offset
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+length > cap(dst) {
+			return nil, errSnappyCorrupt
+		}
+		// The copy may overlap the bytes being written so it is done
+		// a byte at a time.
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != int(dLen) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
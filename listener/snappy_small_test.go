@@ -0,0 +1,100 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      []byte
+		expected string
+	}{
+		{"empty", []byte{0x00}, ""},
+		{"literal", []byte{0x0c, 0x2c, 'h', 'e', 'l', 'l', 'o', ' ', 'w', 'o', 'r', 'l', 'd', '!'}, "hello world!"},
+		{
+			// A literal followed by an overlapping copy with a 1
+			// byte offset (length 9, offset 3).
+			"copy1",
+			[]byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03},
+			"abcabcabcabc",
+		},
+		{
+			// A copy with a 2 byte offset (length 4, offset 2).
+			"copy2",
+			[]byte{0x06, 0x04, 'x', 'y', 0x0e, 0x02, 0x00},
+			"xyxyxy",
+		},
+		{
+			// A copy with a 4 byte offset (length 2, offset 1).
+			"copy4",
+			[]byte{0x03, 0x00, 'z', 0x07, 0x01, 0x00, 0x00, 0x00},
+			"zzz",
+		},
+	}
+	for _, test := range tests {
+		actual, err := snappyDecode(test.src, 0)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, string(actual), test.name)
+	}
+}
+
+func TestSnappyDecodeLongLiteral(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	actual, err := snappyDecode(snappyEncodeLiteral(data), 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, actual)
+}
+
+func TestSnappyDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"no length", []byte{}},
+		{"truncated literal", []byte{0x05, 0x10, 'a', 'b'}},
+		{"truncated literal length", []byte{0x64, 0xf0}},
+		{"too long", []byte{0x02, 0x08, 'a', 'b', 'c'}},
+		{"too short", []byte{0x04, 0x08, 'a', 'b', 'c'}},
+		{"copy before data", []byte{0x04, 0x01, 0x01}},
+		{"zero offset", []byte{0x05, 0x00, 'a', 0x01, 0x00}},
+		{"offset too large", []byte{0x05, 0x00, 'a', 0x01, 0x02}},
+		{"truncated copy", []byte{0x05, 0x00, 'a', 0x02, 0x01}},
+		{"implausible length", []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00, 'a'}},
+	}
+	for _, test := range tests {
+		_, err := snappyDecode(test.src, 0)
+		assert.Equal(t, errSnappyCorrupt, err, test.name)
+	}
+}
+
+func TestSnappyDecodeMaxLen(t *testing.T) {
+	src := snappyEncodeLiteral([]byte("hello world"))
+
+	_, err := snappyDecode(src, 10)
+	assert.Equal(t, errSnappyTooLarge, err)
+
+	actual, err := snappyDecode(src, 11)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(actual))
+}
@@ -0,0 +1,466 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+	"github.com/jumptrading/influx-spout/lineformatter"
+)
+
+// StartStatsdListener initialises a listener configured to accept
+// StatsD metrics over UDP. Metrics are aggregated and published as
+// InfluxDB line protocol at the end of each flush interval. It starts
+// the listener and its statistician and never returns.
+func StartStatsdListener(c *config.Config) (_ *Listener, err error) {
+	if c.StatsdFlushIntervalMS <= 0 {
+		return nil, errors.New("statsd_flush_interval_ms must be greater than 0")
+	}
+	for _, p := range c.StatsdPercentiles {
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid statsd percentile %v", p)
+		}
+	}
+
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			listener.Stop()
+		}
+	}()
+
+	sc, err := listener.setupUDP(c.ReadBufferBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	listener.wg.Add(2)
+	go listener.startStatistician()
+	gaugeExpiry := time.Duration(c.StatsdGaugeExpiryMS) * time.Millisecond
+	go listener.listenStatsd(sc, newStatsdAggregator(c.StatsdPercentiles, gaugeExpiry))
+
+	log.Printf("StatsD listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+// listenStatsd reads StatsD metrics from a UDP socket, adding them to
+// an aggregator which is flushed at the end of each flush interval
+// and when the listener is stopped. Everything happens in the one
+// goroutine so the aggregator doesn't need to be locked.
+func (l *Listener) listenStatsd(sc *net.UDPConn, agg *statsdAggregator) {
+	defer func() {
+		sc.Close()
+		l.wg.Done()
+	}()
+
+	buf := make([]byte, udpMaxDatagramSize)
+	var out []byte
+	flushInterval := time.Duration(l.c.StatsdFlushIntervalMS) * time.Millisecond
+	nextFlush := time.Now().Add(flushInterval)
+
+	l.setReady()
+	for {
+		deadline := time.Now().Add(time.Second)
+		if nextFlush.Before(deadline) {
+			deadline = nextFlush
+		}
+		sc.SetReadDeadline(deadline)
+
+		sz, addr, err := sc.ReadFromUDP(buf)
+		if err != nil && !isTimeout(err) {
+			l.stats.Inc(readErrors)
+		}
+		if sz > 0 && (l.limiter == nil || l.allowDatagram(addr.IP, buf[:sz])) {
+			l.stats.Inc(linesReceived)
+			l.addStatsd(agg, buf[:sz])
+		}
+
+		if now := time.Now(); !now.Before(nextFlush) {
+			out = agg.Flush(out[:0], now)
+			l.publishLines(out)
+			nextFlush = nextFlush.Add(flushInterval)
+			if nextFlush.Before(now) {
+				// Flushing has fallen behind. Skip the missed flushes.
+				nextFlush = now.Add(flushInterval)
+			}
+		}
+
+		select {
+		case <-l.stop:
+			// Don't lose the metrics added since the last flush.
+			l.publishLines(agg.Flush(out[:0], time.Now()))
+			return
+		default:
+		}
+	}
+}
+
+// addStatsd adds each metric in a datagram to an aggregator. Invalid
+// metrics are counted as rejected.
+func (l *Listener) addStatsd(agg *statsdAggregator, datagram []byte) {
+	for _, line := range bytes.Split(datagram, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := agg.Add(string(line)); err != nil {
+			l.stats.Inc(linesRejected)
+			if l.c.Debug {
+				log.Printf("statsd listener: %v", parseError(line, err))
+			}
+		}
+	}
+}
+
+// publishLines publishes newline terminated lines to the listener's
+// NATS subject, split into messages of no more than
+// listener_batch_bytes.
+func (l *Listener) publishLines(lines []byte) {
+	for len(lines) > 0 {
+		chunk := lines
+		if max := l.c.ListenerBatchBytes; len(chunk) > max {
+			i := bytes.LastIndexByte(chunk[:max], '\n')
+			if i == -1 {
+				log.Printf("dropping line longer than the batch buffer (%d bytes)", max)
+				return
+			}
+			chunk = chunk[:i+1]
+		}
+		l.stats.Inc(batchesSent)
+		if err := l.nc.Publish(l.c.NATSSubject[0], chunk); err != nil {
+			l.handleNatsError(err)
+		}
+		lines = lines[len(chunk):]
+	}
+}
+
+var (
+	errStatsdFormat     = errors.New("expected name:value|type")
+	errStatsdType       = errors.New("invalid metric type")
+	errStatsdValue      = errors.New("invalid value")
+	errStatsdSampleRate = errors.New("invalid sample rate")
+)
+
+var (
+	statsdValueFields = []string{"value"}
+	statsdTimerFields = []string{"count", "lower", "upper", "mean", "stddev", "sum"}
+)
+
+func newStatsdAggregator(percentiles []float64, gaugeExpiry time.Duration) *statsdAggregator {
+	a := &statsdAggregator{
+		percentiles: percentiles,
+		gaugeExpiry: gaugeExpiry,
+		timerFields: append([]string(nil), statsdTimerFields...),
+		counters:    make(map[string]*statsdCounter),
+		gauges:      make(map[string]*statsdGauge),
+		timers:      make(map[string]*statsdTimer),
+		sets:        make(map[string]*statsdSet),
+	}
+	for _, p := range percentiles {
+		name := strconv.FormatFloat(p, 'f', -1, 64) + "_percentile"
+		a.timerFields = append(a.timerFields, name)
+	}
+	return a
+}
+
+// statsdAggregator aggregates StatsD metrics between flushes. Metrics
+// are kept separately for each combination of name and tags.
+//
+// As for StatsD, counters, timers and sets are reset after each flush
+// and only those updated since the last flush are published. Gauges
+// keep their value and are published with every flush until they
+// haven't been updated for gaugeExpiry (if greater than 0).
+type statsdAggregator struct {
+	percentiles []float64
+	timerFields []string
+	gaugeExpiry time.Duration
+
+	counters map[string]*statsdCounter
+	gauges   map[string]*statsdGauge
+	timers   map[string]*statsdTimer
+	sets     map[string]*statsdSet
+}
+
+// statsdSeries identifies a metric and formats its lines.
+type statsdSeries struct {
+	formatter *lineformatter.LineFormatter
+	tagVals   []string
+}
+
+type statsdCounter struct {
+	statsdSeries
+	value float64
+}
+
+type statsdGauge struct {
+	statsdSeries
+	value float64
+
+	// updated is true if the gauge has been updated since the last
+	// flush. lastUpdated is the time of the flush following the
+	// gauge's last update.
+	updated     bool
+	lastUpdated time.Time
+}
+
+type statsdTimer struct {
+	statsdSeries
+	count  float64 // may be scaled by the sample rate
+	values []float64
+}
+
+type statsdSet struct {
+	statsdSeries
+	values map[string]struct{}
+}
+
+// statsdMetric is a single parsed StatsD metric.
+type statsdMetric struct {
+	name       string
+	value      string
+	mtype      string
+	sampleRate float64
+	tags       []statsdTag // sorted by key
+}
+
+type statsdTag struct {
+	key, value string
+}
+
+// parseStatsd parses a single StatsD metric of the form:
+//
+//     name:value|type[|@sample_rate][|#tag1:value1,tag2:value2]
+//
+// The tags are in the DogStatsD format. Tags without a value are
+// ignored.
+func parseStatsd(line string) (*statsdMetric, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return nil, errStatsdFormat
+	}
+	i := strings.LastIndexByte(parts[0], ':')
+	if i < 1 || i == len(parts[0])-1 {
+		return nil, errStatsdFormat
+	}
+
+	m := &statsdMetric{
+		name:       parts[0][:i],
+		value:      parts[0][i+1:],
+		mtype:      parts[1],
+		sampleRate: 1,
+	}
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, errStatsdSampleRate
+			}
+			m.sampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+					m.tags = append(m.tags, statsdTag{kv[0], kv[1]})
+				}
+			}
+		}
+	}
+	sort.SliceStable(m.tags, func(i, j int) bool { return m.tags[i].key < m.tags[j].key })
+	return m, nil
+}
+
+// Add parses a single StatsD metric and adds it to the aggregator.
+func (a *statsdAggregator) Add(line string) error {
+	m, err := parseStatsd(line)
+	if err != nil {
+		return err
+	}
+
+	switch m.mtype {
+	case "c":
+		v, err := parseStatsdFloat(m.value)
+		if err != nil {
+			return err
+		}
+		key := m.key()
+		c := a.counters[key]
+		if c == nil {
+			c = &statsdCounter{statsdSeries: m.series(statsdValueFields)}
+			a.counters[key] = c
+		}
+		c.value += v / m.sampleRate
+	case "g":
+		v, err := parseStatsdFloat(m.value)
+		if err != nil {
+			return err
+		}
+		key := m.key()
+		g := a.gauges[key]
+		if g == nil {
+			g = &statsdGauge{statsdSeries: m.series(statsdValueFields)}
+			a.gauges[key] = g
+		}
+		// A leading sign means that the gauge is adjusted rather
+		// than set.
+		if m.value[0] == '+' || m.value[0] == '-' {
+			g.value += v
+		} else {
+			g.value = v
+		}
+		g.updated = true
+	case "ms", "h", "d":
+		v, err := parseStatsdFloat(m.value)
+		if err != nil {
+			return err
+		}
+		key := m.key()
+		t := a.timers[key]
+		if t == nil {
+			t = &statsdTimer{statsdSeries: m.series(a.timerFields)}
+			a.timers[key] = t
+		}
+		t.count += 1 / m.sampleRate
+		t.values = append(t.values, v)
+	case "s":
+		key := m.key()
+		s := a.sets[key]
+		if s == nil {
+			s = &statsdSet{
+				statsdSeries: m.series(statsdValueFields),
+				values:       make(map[string]struct{}),
+			}
+			a.sets[key] = s
+		}
+		s.values[m.value] = struct{}{}
+	default:
+		return errStatsdType
+	}
+	return nil
+}
+
+func parseStatsdFloat(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, errStatsdValue
+	}
+	return v, nil
+}
+
+// key returns the aggregation key for a metric: its name and tags.
+func (m *statsdMetric) key() string {
+	if len(m.tags) == 0 {
+		return m.name
+	}
+	key := []byte(m.name)
+	for _, tag := range m.tags {
+		key = append(key, ',')
+		key = append(key, tag.key...)
+		key = append(key, '=')
+		key = append(key, tag.value...)
+	}
+	return string(key)
+}
+
+// series creates the statsdSeries for a metric.
+func (m *statsdMetric) series(fields []string) statsdSeries {
+	tagKeys := make([]string, 0, len(m.tags))
+	tagVals := make([]string, 0, len(m.tags))
+	for _, tag := range m.tags {
+		// Later tags with the same key take priority.
+		if n := len(tagKeys); n > 0 && tagKeys[n-1] == tag.key {
+			tagVals[n-1] = tag.value
+			continue
+		}
+		tagKeys = append(tagKeys, tag.key)
+		tagVals = append(tagVals, tag.value)
+	}
+	return statsdSeries{
+		formatter: lineformatter.New(m.name, tagKeys, fields...),
+		tagVals:   tagVals,
+	}
+}
+
+// Flush appends a line for each metric to dst and resets the
+// aggregator (see statsdAggregator).
+func (a *statsdAggregator) Flush(dst []byte, now time.Time) []byte {
+	for key, c := range a.counters {
+		dst = append(dst, c.formatter.FormatT(now, c.tagVals, c.value)...)
+		delete(a.counters, key)
+	}
+	for key, g := range a.gauges {
+		if g.updated {
+			g.updated = false
+			g.lastUpdated = now
+		} else if a.gaugeExpiry > 0 && now.Sub(g.lastUpdated) >= a.gaugeExpiry {
+			delete(a.gauges, key)
+			continue
+		}
+		dst = append(dst, g.formatter.FormatT(now, g.tagVals, g.value)...)
+	}
+	for key, t := range a.timers {
+		dst = append(dst, t.formatter.FormatT(now, t.tagVals, t.stats(a.percentiles)...)...)
+		delete(a.timers, key)
+	}
+	for key, s := range a.sets {
+		dst = append(dst, s.formatter.FormatT(now, s.tagVals, len(s.values))...)
+		delete(a.sets, key)
+	}
+	return dst
+}
+
+// stats returns the timer's field values, in the order of
+// statsdTimerFields followed by the percentiles.
+func (t *statsdTimer) stats(percentiles []float64) []interface{} {
+	values := t.values
+	sort.Float64s(values)
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(values)))
+
+	out := []interface{}{t.count, values[0], values[len(values)-1], mean, stddev, sum}
+	for _, p := range percentiles {
+		// Nearest rank
+		i := int(math.Ceil(p/100*float64(len(values)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		out = append(out, values[i])
+	}
+	return out
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var statsdNow = time.Unix(1500000000, 0)
+
+func TestParseStatsd(t *testing.T) {
+	m, err := parseStatsd("foo.bar:1.5|ms|@0.5|#host:web01,env:prod,novalue")
+	require.NoError(t, err)
+	assert.Equal(t, &statsdMetric{
+		name:       "foo.bar",
+		value:      "1.5",
+		mtype:      "ms",
+		sampleRate: 0.5,
+		tags:       []statsdTag{{"env", "prod"}, {"host", "web01"}},
+	}, m)
+	assert.Equal(t, "foo.bar,env=prod,host=web01", m.key())
+}
+
+func TestParseStatsdErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"foo", errStatsdFormat},
+		{"foo:1", errStatsdFormat},
+		{":1|c", errStatsdFormat},
+		{"foo:|c", errStatsdFormat},
+		{"foo:1|c|@0", errStatsdSampleRate},
+		{"foo:1|c|@2", errStatsdSampleRate},
+		{"foo:1|c|@x", errStatsdSampleRate},
+	}
+	for _, test := range tests {
+		_, err := parseStatsd(test.line)
+		assert.Equal(t, test.err, err, test.line)
+	}
+}
+
+func TestStatsdCounters(t *testing.T) {
+	a := newStatsdAggregator(nil, 0)
+	addStatsd(t, a,
+		"hits:1|c",
+		"hits:2|c",
+		"hits:1|c|@0.1",
+		"hits:5|c|#host:a",
+	)
+	assertStatsdFlush(t, a,
+		"hits value=13 1500000000000000000",
+		"hits,host=a value=5 1500000000000000000",
+	)
+
+	// Counters are reset.
+	assertStatsdFlush(t, a)
+}
+
+func TestStatsdGauges(t *testing.T) {
+	a := newStatsdAggregator(nil, 0)
+	addStatsd(t, a,
+		"temp:10|g",
+		"temp:+5|g",
+		"temp:-2.5|g",
+	)
+	assertStatsdFlush(t, a, "temp value=12.5 1500000000000000000")
+
+	// Gauges keep their value.
+	assertStatsdFlush(t, a, "temp value=12.5 1500000000000000000")
+	addStatsd(t, a, "temp:-0.5|g")
+	assertStatsdFlush(t, a, "temp value=12 1500000000000000000")
+	addStatsd(t, a, "temp:3|g")
+	assertStatsdFlush(t, a, "temp value=3 1500000000000000000")
+}
+
+func TestStatsdGaugeExpiry(t *testing.T) {
+	a := newStatsdAggregator(nil, time.Minute)
+	addStatsd(t, a, "temp:10|g", "load:1|g")
+	assertStatsdFlushAt(t, a, statsdNow, "temp value=10 1500000000000000000", "load value=1 1500000000000000000")
+
+	// Updating a gauge keeps it from expiring.
+	addStatsd(t, a, "load:+1|g")
+	assertStatsdFlushAt(t, a, statsdNow.Add(30*time.Second),
+		"temp value=10 1500000030000000000", "load value=2 1500000030000000000")
+	assertStatsdFlushAt(t, a, statsdNow.Add(time.Minute), "load value=2 1500000060000000000")
+	assertStatsdFlushAt(t, a, statsdNow.Add(90*time.Second))
+
+	// An expired gauge starts again from 0.
+	addStatsd(t, a, "load:+3|g")
+	assertStatsdFlushAt(t, a, statsdNow.Add(2*time.Minute), "load value=3 1500000120000000000")
+}
+
+func TestStatsdTimers(t *testing.T) {
+	a := newStatsdAggregator([]float64{50, 90}, 0)
+	for _, v := range []string{"4", "2", "8", "6", "10"} {
+		addStatsd(t, a, "resp:"+v+"|ms")
+	}
+	addStatsd(t, a, "size:3|h|@0.5")
+	assertStatsdFlush(t, a,
+		"resp count=5,lower=2,upper=10,mean=6,stddev=2.8284271247461903,sum=30,50_percentile=6,90_percentile=10 1500000000000000000",
+		"size count=2,lower=3,upper=3,mean=3,stddev=0,sum=3,50_percentile=3,90_percentile=3 1500000000000000000",
+	)
+	assertStatsdFlush(t, a)
+}
+
+func TestStatsdSets(t *testing.T) {
+	a := newStatsdAggregator(nil, 0)
+	addStatsd(t, a,
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	)
+	assertStatsdFlush(t, a, "users value=2 1500000000000000000")
+	assertStatsdFlush(t, a)
+}
+
+func TestStatsdEscaping(t *testing.T) {
+	a := newStatsdAggregator(nil, 0)
+	addStatsd(t, a, "my metric,x:1|c|#a=b:c d,e:1,e:2")
+	assertStatsdFlush(t, a, `my\ metric\,x,a\=b=c\ d,e=2 value=1 1500000000000000000`)
+}
+
+func TestStatsdAddErrors(t *testing.T) {
+	a := newStatsdAggregator(nil, 0)
+	assert.Equal(t, errStatsdFormat, a.Add("foo"))
+	assert.Equal(t, errStatsdType, a.Add("foo:1|x"))
+	assert.Equal(t, errStatsdValue, a.Add("foo:x|c"))
+	assert.Equal(t, errStatsdValue, a.Add("foo:NaN|g"))
+	assert.Equal(t, errStatsdValue, a.Add("foo:x|ms"))
+	assertStatsdFlush(t, a)
+}
+
+func addStatsd(t *testing.T, a *statsdAggregator, lines ...string) {
+	for _, line := range lines {
+		require.NoError(t, a.Add(line), line)
+	}
+}
+
+// assertStatsdFlush flushes an aggregator and checks the lines
+// produced. The lines are compared in sorted order as they are
+// produced in no particular order.
+func assertStatsdFlush(t *testing.T, a *statsdAggregator, expected ...string) {
+	assertStatsdFlushAt(t, a, statsdNow, expected...)
+}
+
+func assertStatsdFlushAt(t *testing.T, a *statsdAggregator, now time.Time, expected ...string) {
+	out := string(a.Flush(nil, now))
+	var actual []string
+	if out != "" {
+		require.True(t, strings.HasSuffix(out, "\n"))
+		actual = strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	}
+	sort.Strings(actual)
+	sort.Strings(expected)
+	assert.Equal(t, expected, actual)
+}
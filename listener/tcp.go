@@ -0,0 +1,299 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumptrading/influx-spout/config"
+	"github.com/jumptrading/influx-spout/lineformatter"
+	"github.com/jumptrading/influx-spout/stats"
+)
+
+const (
+	// Per-connection stats counters
+	connLines = "lines"
+	connBytes = "bytes"
+
+	// streamMaxLineBytes is the longest line which will be accepted
+	// over a TCP or Unix stream connection.
+	streamMaxLineBytes = udpMaxDatagramSize
+)
+
+// StartTCPListener initialises a listener configured to accept
+// newline delimited lines over long-lived TCP connections. It starts
+// the listener and its statistician and never returns.
+func StartTCPListener(c *config.Config) (_ *Listener, err error) {
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			listener.Stop()
+		}
+	}()
+
+	ln, err := listener.setupTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	listener.wg.Add(3)
+	go listener.startStatistician()
+	go listener.startBatchFlusher()
+	go listener.listenStream(ln)
+
+	log.Printf("TCP listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+// streamConn holds the details of a single inbound TCP or Unix stream
+// connection.
+type streamConn struct {
+	remote     string // used in logs
+	host       string // used to tag stats
+	stats      *stats.Stats
+	converted  []byte // used when converting Graphite or OpenTSDB lines
+	normalised []byte // used when converting timestamps
+}
+
+func (l *Listener) setupTCP() (*net.TCPListener, error) {
+	serverAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", l.c.Port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP socket: %v", err)
+	}
+	ln, err := net.ListenTCP("tcp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listener bound to TCP socket: %v\n", ln.Addr().String())
+	return ln, nil
+}
+
+// streamListener is implemented by *net.TCPListener and
+// *net.UnixListener.
+type streamListener interface {
+	net.Listener
+	SetDeadline(time.Time) error
+}
+
+func (l *Listener) listenStream(ln streamListener) {
+	defer func() {
+		ln.Close()
+		l.wg.Done()
+	}()
+
+	l.setReady()
+	for {
+		ln.SetDeadline(time.Now().Add(time.Second))
+		conn, err := ln.Accept()
+		if err == nil {
+			l.acceptConn(conn)
+		} else if !isTimeout(err) {
+			log.Printf("failed to accept connection: %v", err)
+		}
+
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (l *Listener) acceptConn(conn net.Conn) {
+	tc := &streamConn{
+		remote: l.remoteName(conn),
+		host:   remoteHost(conn),
+		stats:  stats.New(connLines, connBytes),
+	}
+	if !l.addConn(tc) {
+		log.Printf("rejecting connection from %s: connection limit (%d) reached",
+			tc.remote, l.c.ListenerMaxConnections)
+		conn.Close()
+		return
+	}
+
+	l.wg.Add(1)
+	if l.httpConns != nil {
+		go l.routeConn(conn, tc)
+	} else {
+		go l.handleConn(conn, tc)
+	}
+}
+
+// remoteName returns a name for the remote end of a connection, for
+// use in logs and stats. Unix socket clients are normally unnamed so
+// these are numbered instead.
+func (l *Listener) remoteName(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		return addr.String()
+	}
+	return fmt.Sprintf("unix-%d", atomic.AddUint64(&l.unixConnSeq, 1))
+}
+
+// remoteHost returns the host at the remote end of a connection, for
+// tagging stats. The source port is left out because it changes with
+// every connection. All Unix socket clients share the host "unix".
+func remoteHost(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil || addr.Network() != "tcp" {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (l *Listener) addConn(tc *streamConn) bool {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	max := l.c.ListenerMaxConnections
+	if max > 0 && len(l.conns) >= max {
+		return false
+	}
+	l.conns[tc] = struct{}{}
+	return true
+}
+
+func (l *Listener) removeConn(tc *streamConn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	delete(l.conns, tc)
+}
+
+func (l *Listener) handleConn(conn net.Conn, tc *streamConn) {
+	defer func() {
+		conn.Close()
+		l.removeConn(tc)
+		l.wg.Done()
+	}()
+
+	idleTimeout := time.Duration(l.c.ListenerIdleTimeoutSecs) * time.Second
+	lastLine := time.Now()
+
+	// Reads go into a per-connection buffer so that only complete
+	// lines are passed on to the batch buffer.
+	lr := newLineReader(make([]byte, streamMaxLineBytes))
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		lines, err := lr.Read(conn)
+		if len(lines) > 0 {
+			lastLine = time.Now()
+			l.sendConnLines(conn, tc, lines)
+		}
+
+		if err == errLineTooLong {
+			log.Printf("closing connection from %s: line longer than %d bytes",
+				tc.remote, streamMaxLineBytes)
+			l.stats.Inc(readErrors)
+			return
+		} else if err == io.EOF {
+			// The final line doesn't need to be newline terminated.
+			if line := lr.Remainder(); line != nil {
+				l.sendConnLines(conn, tc, line)
+			}
+			return
+		} else if err != nil && !isTimeout(err) {
+			l.stats.Inc(readErrors)
+			return
+		}
+
+		if idleTimeout > 0 && time.Since(lastLine) > idleTimeout {
+			if l.c.Debug {
+				log.Printf("closing idle connection from %s", tc.remote)
+			}
+			return
+		}
+
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (l *Listener) sendConnLines(conn net.Conn, tc *streamConn, lines []byte) {
+	tc.stats.Add(connLines, bytes.Count(lines, []byte{'\n'}))
+	tc.stats.Add(connBytes, len(lines))
+
+	if l.graphite != nil {
+		tc.converted = l.convertGraphite(tc.converted[:0], lines)
+		lines = tc.converted
+	} else if l.openTSDB {
+		tc.converted = l.convertOpenTSDB(tc.converted[:0], lines, conn)
+		lines = tc.converted
+	}
+	if l.c.ListenerValidate {
+		lines = l.validateLines(lines)
+	}
+	if l.precisionMult != 0 {
+		var err error
+		tc.normalised, err = normaliseLines(tc.normalised[:0], lines, l.precisionMult, time.Now())
+		if err != nil && l.c.Debug {
+			log.Printf("connection from %s: %v", tc.remote, err)
+		}
+		lines = tc.normalised
+	}
+	l.appendBatch(l.batch, lines)
+}
+
+var connStatsLine = lineformatter.New(
+	"spout_stat_listener_conn",
+	[]string{"listener", "remote"},
+	"lines",
+	"bytes",
+)
+
+// publishConnStats sends the stats for the open TCP or Unix stream
+// connections to the monitor subject. The stats are summed for each
+// remote host so that the number of series stays bounded.
+func (l *Listener) publishConnStats(listenerName string) {
+	l.connsMu.Lock()
+	byHost := make(map[string]*[2]int)
+	for tc := range l.conns {
+		sums := byHost[tc.host]
+		if sums == nil {
+			sums = new([2]int)
+			byHost[tc.host] = sums
+		}
+		st := tc.stats.Clone()
+		sums[0] += st.Get(connLines)
+		sums[1] += st.Get(connBytes)
+	}
+	l.connsMu.Unlock()
+
+	for host, sums := range byHost {
+		l.nc.Publish(l.c.NATSSubjectMonitor, connStatsLine.Format(
+			[]string{listenerName, host},
+			sums[0],
+			sums[1],
+		))
+	}
+}
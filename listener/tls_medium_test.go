@@ -0,0 +1,231 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build medium
+
+package listener
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPListenerTLS(t *testing.T) {
+	certs := newTestCerts(t)
+	defer certs.Close()
+
+	conf := testConfig()
+	conf.TLSCertFile = certs.serverCert
+	conf.TLSKeyFile = certs.serverKey
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	client := certs.client(t, false)
+	resp, err := client.Post(writeURL("https"), "text/plain", bytes.NewBufferString(poetry[0]))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, poetry[0])
+
+	// Plain HTTP isn't accepted.
+	resp, err = http.Post(writeURL("http"), "text/plain", bytes.NewBufferString(poetry[1]))
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	assertNoMore(t, listenerCh)
+}
+
+func TestHTTPListenerMutualTLS(t *testing.T) {
+	certs := newTestCerts(t)
+	defer certs.Close()
+
+	conf := testConfig()
+	conf.TLSCertFile = certs.serverCert
+	conf.TLSKeyFile = certs.serverKey
+	conf.TLSClientCAFile = certs.caCert
+	listener, err := StartHTTPListener(conf)
+	require.NoError(t, err)
+	assertListenerStarted(t, listener)
+	defer listener.Stop()
+
+	listenerCh, unsubListener := subListener(t)
+	defer unsubListener()
+
+	client := certs.client(t, true)
+	resp, err := client.Post(writeURL("https"), "text/plain", bytes.NewBufferString(poetry[0]))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertBatch(t, listenerCh, poetry[0])
+
+	// Clients without a certificate are rejected.
+	client = certs.client(t, false)
+	_, err = client.Post(writeURL("https"), "text/plain", bytes.NewBufferString(poetry[1]))
+	assert.Error(t, err)
+	assertNoMore(t, listenerCh)
+}
+
+func TestHTTPListenerTLSConfigErrors(t *testing.T) {
+	certs := newTestCerts(t)
+	defer certs.Close()
+
+	check := func(certFile, keyFile, caFile, expected string) {
+		conf := testConfig()
+		conf.TLSCertFile = certFile
+		conf.TLSKeyFile = keyFile
+		conf.TLSClientCAFile = caFile
+		_, err := StartHTTPListener(conf)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), expected)
+	}
+
+	check(certs.serverCert, "", "", "tls_cert_file and tls_key_file must be set together")
+	check("", "", certs.caCert, "tls_client_ca_file requires tls_cert_file and tls_key_file")
+	check(certs.serverCert, certs.caCert, "", "failed to load TLS certificate")
+	check(certs.serverCert, certs.serverKey, "/does/not/exist", "failed to load TLS client CA")
+	check(certs.serverCert, certs.serverKey, certs.serverKey, "no certificates found in")
+}
+
+func writeURL(scheme string) string {
+	return fmt.Sprintf("%s://localhost:%d/write", scheme, listenPort)
+}
+
+// testCerts holds the paths to a freshly generated CA along with
+// server and client certificates signed by it.
+type testCerts struct {
+	dir        string
+	caCert     string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+	pool       *x509.CertPool
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir, err := ioutil.TempDir("", "listener-tls")
+	require.NoError(t, err)
+	certs := &testCerts{
+		dir:        dir,
+		caCert:     filepath.Join(dir, "ca.pem"),
+		serverCert: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server-key.pem"),
+		clientCert: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client-key.pem"),
+		pool:       x509.NewCertPool(),
+	}
+
+	caTemplate := certTemplate(1, "test CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	caKey := genKey(t)
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	certs.pool.AddCert(ca)
+	writePEM(t, certs.caCert, "CERTIFICATE", caDER)
+
+	serverTemplate := certTemplate(2, "localhost")
+	serverTemplate.DNSNames = []string{"localhost"}
+	serverTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	writeSignedCert(t, serverTemplate, ca, caKey, certs.serverCert, certs.serverKey)
+
+	clientTemplate := certTemplate(3, "client")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	writeSignedCert(t, clientTemplate, ca, caKey, certs.clientCert, certs.clientKey)
+
+	return certs
+}
+
+func (c *testCerts) Close() {
+	os.RemoveAll(c.dir)
+}
+
+// client returns a HTTP client which trusts the test CA, optionally
+// presenting the client certificate.
+func (c *testCerts) client(t *testing.T, withCert bool) *http.Client {
+	tlsConfig := &tls.Config{RootCAs: c.pool}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		require.NoError(t, err)
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+func certTemplate(serial int64, commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+func genKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func writeSignedCert(
+	t *testing.T,
+	template, ca *x509.Certificate,
+	caKey *ecdsa.PrivateKey,
+	certFile, keyFile string,
+) {
+	key := genKey(t)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	writePEM(t, certFile, "CERTIFICATE", der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, fileName, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(fileName, data, 0600))
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// udpReadBatch is the maximum number of datagrams read at once by
+// each socket of a multi-socket UDP listener.
+const udpReadBatch = 16
+
+// startUDPSockets opens n UDP sockets bound to the same port using
+// SO_REUSEPORT, leaving the kernel to spread incoming datagrams
+// between them. Each socket is read by its own goroutine into its own
+// batch, which has its own lock, so that the sockets never contend
+// with each other.
+func (l *Listener) startUDPSockets(n int) error {
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		sc, err := listenUDPReusePort(l.c.Port)
+		if err == nil {
+			err = sc.SetReadBuffer(roundUpToPageSize(l.c.ReadBufferBytes))
+		}
+		if err != nil {
+			for _, sc := range conns {
+				sc.Close()
+			}
+			return err
+		}
+		conns = append(conns, sc)
+	}
+	log.Printf("listener bound to %d UDP sockets: %v\n", n, conns[0].LocalAddr().String())
+
+	l.wg.Add(1 + n)
+	go l.startStatistician()
+	for i, sc := range conns {
+		b := l.batch
+		if i > 0 {
+			b = newBatch(l.c.NATSSubject[0], l.c.ListenerBatchBytes)
+		}
+		go l.listenUDPBatched(sc, b)
+	}
+	l.setReady()
+	return nil
+}
+
+// listenUDPBatched reads from a single socket of a multi-socket UDP
+// listener. Where supported, several datagrams are read with each
+// system call (see mmsgReader).
+func (l *Listener) listenUDPBatched(sc *net.UDPConn, b *batch) {
+	defer func() {
+		sc.Close()
+		l.wg.Done()
+	}()
+
+	r, err := newMmsgReader(sc, udpReadBatch)
+	if err != nil {
+		log.Printf("failed to set up UDP reader: %v", err)
+		return
+	}
+
+	var dp *datagramProcessor
+	if l.processDatagrams() {
+		dp = l.newDatagramProcessor(b)
+	}
+
+	for {
+		sc.SetReadDeadline(l.readDeadline(b))
+		datagrams, err := r.Read()
+		if err != nil && !isTimeout(err) {
+			l.stats.Inc(readErrors)
+		}
+
+		for i, datagram := range datagrams {
+			if l.limiter != nil && !l.allowDatagram(r.SourceIP(i), datagram) {
+				continue
+			}
+			if dp != nil {
+				dp.Add(datagram)
+				continue
+			}
+			// processRead sends the batch before there is less than
+			// a maximum sized datagram of room left.
+			b.mu.Lock()
+			sz := copy(b.buf[b.size:len(b.buf)-1], datagram)
+			l.processRead(b, terminateDatagram(b.buf[b.size:], sz))
+			b.mu.Unlock()
+		}
+		l.sendExpiredBatch(b)
+
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+	}
+}
+
+// processDatagrams returns true if received datagrams need to be
+// processed (see datagramProcessor) before being added to a batch.
+func (l *Listener) processDatagrams() bool {
+	return l.c.ListenerValidate || l.precisionMult != 0 || l.graphite != nil
+}
+
+func (l *Listener) newDatagramProcessor(b *batch) *datagramProcessor {
+	return &datagramProcessor{l: l, b: b}
+}
+
+// terminateDatagram newline terminates the datagram of sz bytes at the
+// start of buf if required, returning its new size. The end of a
+// datagram is always the end of a line, as for InfluxDB's UDP service,
+// so lines are never joined across datagrams (which may come from
+// different hosts). buf must have room for the newline.
+func terminateDatagram(buf []byte, sz int) int {
+	if sz > 0 && buf[sz-1] != '\n' {
+		buf[sz] = '\n'
+		sz++
+	}
+	return sz
+}
+
+// datagramProcessor converts Graphite lines, validates lines and
+// converts their timestamps (as configured) before adding them to a
+// batch. Each datagram is taken to be complete (see
+// terminateDatagram).
+type datagramProcessor struct {
+	l          *Listener
+	b          *batch
+	lines      []byte
+	converted  []byte
+	normalised []byte
+}
+
+func (p *datagramProcessor) Add(datagram []byte) {
+	if len(datagram) == 0 {
+		return
+	}
+
+	lines := datagram
+	if p.l.graphite != nil {
+		p.converted = p.l.convertGraphite(p.converted[:0], datagram)
+		lines = p.converted
+	} else if datagram[len(datagram)-1] != '\n' {
+		p.lines = append(append(p.lines[:0], datagram...), '\n')
+		lines = p.lines
+	}
+
+	if p.l.c.ListenerValidate {
+		lines = p.l.validateLines(lines)
+	}
+	if p.l.precisionMult != 0 {
+		var err error
+		p.normalised, err = normaliseLines(p.normalised[:0], lines, p.l.precisionMult, time.Now())
+		if err != nil && p.l.c.Debug {
+			log.Printf("datagram listener: %v", err)
+		}
+		lines = p.normalised
+	}
+	p.l.appendBatch(p.b, lines)
+}
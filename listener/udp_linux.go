@@ -0,0 +1,160 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDPReusePort creates a UDP socket bound to port on all
+// addresses with SO_REUSEPORT set, allowing several sockets to share
+// the port. The socket is created by hand as the option must be set
+// before the socket is bound.
+func listenUDPReusePort(port int) (*net.UDPConn, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	var sa unix.Sockaddr = &unix.SockaddrInet6{Port: port}
+	if err == unix.EAFNOSUPPORT {
+		// No IPv6 support.
+		fd, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		sa = &unix.SockaddrInet4{Port: port}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP socket: %v", err)
+	}
+
+	// The fd is duplicated by net.FilePacketConn so this copy is
+	// always closed.
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("udp:%d", port))
+	defer f.Close()
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		return nil, fmt.Errorf("failed to set SO_REUSEPORT: %v", err)
+	}
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		// Accept IPv4 datagrams too (like net.ListenUDP does).
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("failed to bind UDP socket: %v", err)
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// mmsghdr matches struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func newMmsgReader(sc *net.UDPConn, n int) (*mmsgReader, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmsgReader{
+		rc:    rc,
+		bufs:  make([][]byte, n),
+		iovs:  make([]unix.Iovec, n),
+		names: make([]unix.RawSockaddrAny, n),
+		msgs:  make([]mmsghdr, n),
+		out:   make([][]byte, 0, n),
+	}
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, udpMaxDatagramSize)
+		r.iovs[i].Base = &r.bufs[i][0]
+		r.iovs[i].SetLen(udpMaxDatagramSize)
+		r.msgs[i].hdr.Iov = &r.iovs[i]
+		r.msgs[i].hdr.Iovlen = 1
+		r.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+	}
+	return r, nil
+}
+
+// mmsgReader reads several datagrams from a UDP socket with a single
+// recvmmsg system call.
+type mmsgReader struct {
+	rc    syscall.RawConn
+	bufs  [][]byte
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny // sender addresses
+	msgs  []mmsghdr
+	out   [][]byte
+}
+
+// Read waits for at least one datagram to arrive (or for the socket's
+// read deadline to pass) and returns the datagrams available. The
+// returned slices are only valid until the next call to Read.
+func (r *mmsgReader) Read() ([][]byte, error) {
+	for i := range r.msgs {
+		r.msgs[i].hdr.Namelen = unix.SizeofSockaddrAny
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := r.rc.Read(func(fd uintptr) bool {
+		for {
+			r1, _, e := syscall.Syscall6(unix.SYS_RECVMMSG, fd,
+				uintptr(unsafe.Pointer(&r.msgs[0])), uintptr(len(r.msgs)),
+				unix.MSG_DONTWAIT, 0, 0)
+			switch e {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false // wait until the socket is readable
+			}
+			n, errno = int(r1), e
+			return true
+		}
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.out = r.out[:0]
+	for i := 0; i < n; i++ {
+		r.out = append(r.out, r.bufs[i][:r.msgs[i].len])
+	}
+	return r.out, nil
+}
+
+// SourceIP returns the IP address of the sender of the i'th datagram
+// returned by the last call to Read.
+func (r *mmsgReader) SourceIP(i int) net.IP {
+	name := unsafe.Pointer(&r.names[i])
+	switch r.names[i].Addr.Family {
+	case unix.AF_INET6:
+		return net.IP((*unix.RawSockaddrInet6)(name).Addr[:])
+	case unix.AF_INET:
+		return net.IP((*unix.RawSockaddrInet4)(name).Addr[:])
+	}
+	return nil
+}
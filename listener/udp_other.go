@@ -0,0 +1,62 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+func listenUDPReusePort(port int) (*net.UDPConn, error) {
+	return nil, errors.New("multiple UDP sockets are only supported on Linux")
+}
+
+func newMmsgReader(sc *net.UDPConn, n int) (*mmsgReader, error) {
+	return &mmsgReader{
+		sc:  sc,
+		buf: make([]byte, udpMaxDatagramSize),
+		out: make([][]byte, 1),
+	}, nil
+}
+
+// mmsgReader reads one datagram at a time on platforms without
+// recvmmsg.
+type mmsgReader struct {
+	sc   *net.UDPConn
+	buf  []byte
+	out  [][]byte
+	addr *net.UDPAddr
+}
+
+func (r *mmsgReader) Read() ([][]byte, error) {
+	n, addr, err := r.sc.ReadFromUDP(r.buf)
+	if n < 1 {
+		return nil, err
+	}
+	r.out[0] = r.buf[:n]
+	r.addr = addr
+	return r.out, err
+}
+
+// SourceIP returns the IP address of the sender of the datagram
+// returned by the last call to Read.
+func (r *mmsgReader) SourceIP(i int) net.IP {
+	if r.addr == nil {
+		return nil
+	}
+	return r.addr.IP
+}
@@ -0,0 +1,235 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jumptrading/influx-spout/config"
+)
+
+// StartUnixListener initialises a listener configured to accept
+// lines on a Unix domain socket. Depending on the configuration, this
+// is either a stream socket (handled like the TCP listener) or a
+// datagram socket (handled like the UDP listener). It starts the
+// listener and its statistician and never returns.
+func StartUnixListener(c *config.Config) (_ *Listener, err error) {
+	if c.ListenerSocketPath == "" {
+		return nil, errors.New("listener_socket_path must be set")
+	}
+
+	listener, err := newListener(c)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			listener.Stop()
+		}
+	}()
+
+	switch c.ListenerSocketType {
+	case "stream":
+		ln, err := listener.setupUnix()
+		if err != nil {
+			return nil, err
+		}
+		listener.wg.Add(3)
+		go listener.startStatistician()
+		go listener.startBatchFlusher()
+		go listener.listenStream(ln)
+	case "datagram":
+		sc, err := listener.setupUnixgram(c.ReadBufferBytes)
+		if err != nil {
+			return nil, err
+		}
+		listener.wg.Add(2)
+		go listener.startStatistician()
+		go listener.listenDatagrams(sc)
+	default:
+		return nil, fmt.Errorf("invalid listener_socket_type %q (use stream or datagram)",
+			c.ListenerSocketType)
+	}
+
+	log.Printf("Unix listener publishing to [%s] at %s", c.NATSSubject[0], c.NATSAddress)
+	listener.notifyState("ready")
+
+	return listener, nil
+}
+
+func (l *Listener) setupUnix() (streamListener, error) {
+	var ln *net.UnixListener
+	err := l.bindUnixSocket(func(path string) (err error) {
+		ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		return err
+	}, func() {
+		if ln != nil {
+			ln.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file was bound under a temporary name so it is
+	// removed explicitly on close (see unixListener).
+	ln.SetUnlinkOnClose(false)
+
+	log.Printf("listener bound to Unix stream socket: %s\n", l.c.ListenerSocketPath)
+	return unixListener{ln, l.c.ListenerSocketPath}, nil
+}
+
+func (l *Listener) setupUnixgram(configBufSize int) (datagramConn, error) {
+	var sc *net.UnixConn
+	err := l.bindUnixSocket(func(path string) (err error) {
+		sc, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err == nil {
+			err = sc.SetReadBuffer(roundUpToPageSize(configBufSize))
+		}
+		return err
+	}, func() {
+		if sc != nil {
+			sc.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listener bound to Unix datagram socket: %s\n", l.c.ListenerSocketPath)
+	return unixgramConn{sc, l.c.ListenerSocketPath}, nil
+}
+
+// unixListener removes the socket file when a Unix stream socket is
+// closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (ln unixListener) Close() error {
+	err := ln.UnixListener.Close()
+	os.Remove(ln.path)
+	return err
+}
+
+// unixgramConn removes the socket file when a Unix datagram socket is
+// closed.
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	os.Remove(c.path)
+	return err
+}
+
+// bindUnixSocket creates the socket file at the configured path by
+// calling bind. So that clients can never connect before the
+// configured permissions and ownership have been applied, bind is
+// given a path within a new private directory. The socket file is
+// only moved to the configured path once it is ready. close is called
+// to close the socket if this fails after bind has succeeded.
+func (l *Listener) bindUnixSocket(bind func(path string) error, close func()) error {
+	path := l.c.ListenerSocketPath
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".influx-spout-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "socket")
+	if err := bind(tmpPath); err != nil {
+		close()
+		return err
+	}
+	err = l.setSocketPermissions(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		close()
+		return err
+	}
+	return nil
+}
+
+// removeStaleSocket removes any stale socket left at path (e.g. after
+// a crash) so that it can be bound to again. Files which aren't
+// sockets are left alone.
+func removeStaleSocket(path string) error {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSocketPermissions applies the configured permissions and
+// ownership to the socket file at path.
+func (l *Listener) setSocketPermissions(path string) error {
+	if l.c.ListenerSocketMode != "" {
+		mode, err := strconv.ParseUint(l.c.ListenerSocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid listener_socket_mode %q", l.c.ListenerSocketMode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if l.c.ListenerSocketOwner == "" && l.c.ListenerSocketGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1 // -1 leaves the value unchanged
+	if owner := l.c.ListenerSocketOwner; owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			u, err = user.LookupId(owner)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid listener_socket_owner: %v", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group := l.c.ListenerSocketGroup; group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid listener_socket_group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+)
+
+var (
+	errInvalidEscape      = errors.New("invalid escape")
+	errMissingTagKey      = errors.New("missing tag key")
+	errMissingTagValue    = errors.New("missing tag value")
+	errMissingFieldKey    = errors.New("missing field key")
+	errMissingFieldValue  = errors.New("missing field value")
+	errInvalidFieldValue  = errors.New("invalid field value")
+	errUnterminatedString = errors.New("unterminated string field value")
+)
+
+// validateLines removes invalid lines (as well as blank lines and
+// comments) from a block of lines, in place. Invalid lines are
+// published to the invalid lines subject. The final line doesn't need
+// to be newline terminated.
+func (l *Listener) validateLines(lines []byte) []byte {
+	lines, _ = l.validateHTTPLines(lines)
+	return lines
+}
+
+// validateHTTPLines is like validateLines but also returns an error
+// describing the first invalid line, which is used in HTTP responses.
+func (l *Listener) validateHTTPLines(lines []byte) ([]byte, error) {
+	var firstErr error
+	out := filterLines(lines, validateLine, func(line []byte, err error) {
+		l.stats.Inc(linesRejected)
+		l.publishInvalid(line, err)
+		if firstErr == nil {
+			firstErr = parseError(line, err)
+		}
+	})
+
+	accepted := bytes.Count(out, []byte{'\n'})
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		accepted++
+	}
+	l.stats.Add(linesAccepted, accepted)
+	return out, firstErr
+}
+
+// invalidLine is published to the invalid lines subject for each
+// line which fails validation.
+type invalidLine struct {
+	Reason string `json:"reason"`
+	Line   string `json:"line"`
+}
+
+func (l *Listener) publishInvalid(line []byte, reason error) {
+	msg, err := json.Marshal(invalidLine{
+		Reason: reason.Error(),
+		Line:   string(bytes.TrimRight(line, "\r\n")),
+	})
+	if err != nil {
+		log.Printf("failed to encode invalid line: %v", err)
+		return
+	}
+	if err := l.nc.Publish(l.c.NATSSubjectInvalid, msg); err != nil {
+		l.handleNatsError(err)
+	}
+}
+
+// validateLine fully checks the syntax of a single line of InfluxDB
+// line protocol: the measurement, tags, fields (including their
+// types) and the optional timestamp. Unlike checkLine, it is
+// relatively expensive so it is only used when validation is enabled.
+func validateLine(line []byte) error {
+	line = bytes.TrimRight(line, " \r\n")
+	if len(line) == 0 || line[0] == ',' || line[0] == ' ' {
+		return errMissingMeasurement
+	}
+
+	// Measurement
+	i, err := scanKey(line, 0, ", ")
+	if err != nil {
+		return err
+	}
+
+	// Tags
+	for i < len(line) && line[i] == ',' {
+		start := i + 1
+		i, err = scanKey(line, start, "=, ")
+		if err != nil {
+			return err
+		}
+		if i == start {
+			return errMissingTagKey
+		}
+		if i == len(line) || line[i] != '=' {
+			return errMissingTagValue
+		}
+		start = i + 1
+		i, err = scanKey(line, start, ", ")
+		if err != nil {
+			return err
+		}
+		if i == start {
+			return errMissingTagValue
+		}
+	}
+
+	// Fields
+	if i == len(line) || i+1 == len(line) {
+		return errMissingFields
+	}
+	for {
+		start := i + 1
+		i, err = scanKey(line, start, "=, ")
+		if err != nil {
+			return err
+		}
+		if i == start {
+			return errMissingFieldKey
+		}
+		if i == len(line) || line[i] != '=' {
+			return errMissingFieldValue
+		}
+		i, err = scanFieldValue(line, i+1)
+		if err != nil {
+			return err
+		}
+		if i == len(line) || line[i] == ' ' {
+			break
+		}
+		// line[i] must be a comma so there's another field.
+	}
+
+	// Timestamp
+	if i < len(line) {
+		if _, err := parseInt(line[i+1:]); err != nil {
+			return errInvalidTimestamp
+		}
+	}
+	return nil
+}
+
+// scanKey scans a measurement, tag key, tag value or field key
+// starting at line[i], returning the index of the first unescaped
+// byte from stop (or the end of line).
+func scanKey(line []byte, i int, stop string) (int, error) {
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' {
+			i++
+			if i == len(line) {
+				return i, errInvalidEscape
+			}
+			continue
+		}
+		if strings.IndexByte(stop, c) >= 0 {
+			return i, nil
+		}
+	}
+	return i, nil
+}
+
+// scanFieldValue checks the field value starting at line[i] and
+// returns the index just after it.
+func scanFieldValue(line []byte, i int) (int, error) {
+	if i == len(line) || line[i] == ',' || line[i] == ' ' {
+		return i, errMissingFieldValue
+	}
+
+	if line[i] == '"' {
+		for i++; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++ // skip the escaped character
+			case '"':
+				i++
+				if i < len(line) && line[i] != ',' && line[i] != ' ' {
+					return i, errInvalidFieldValue
+				}
+				return i, nil
+			}
+		}
+		return i, errUnterminatedString
+	}
+
+	end := i
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	if !isValidFieldValue(line[i:end]) {
+		return end, errInvalidFieldValue
+	}
+	return end, nil
+}
+
+// isValidFieldValue returns true if v is a valid (unquoted) float,
+// integer, unsigned integer or boolean field value.
+func isValidFieldValue(v []byte) bool {
+	switch string(v) {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return true
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		_, err := parseInt(v[:len(v)-1])
+		return err == nil
+	case 'u':
+		return len(v) > 1 && v[0] != '-' && isDigits(v[:len(v)-1])
+	}
+	return isValidFloat(v)
+}
+
+// isValidFloat checks float syntax without allocating: an optional
+// sign, digits with an optional decimal point, and an optional
+// exponent.
+func isValidFloat(v []byte) bool {
+	if len(v) > 0 && (v[0] == '-' || v[0] == '+') {
+		v = v[1:]
+	}
+	mantissa := v
+	var exponent []byte
+	if i := bytes.IndexAny(v, "eE"); i >= 0 {
+		mantissa, exponent = v[:i], v[i+1:]
+		if len(exponent) > 0 && (exponent[0] == '-' || exponent[0] == '+') {
+			exponent = exponent[1:]
+		}
+		if !isDigits(exponent) {
+			return false
+		}
+	}
+
+	intPart, fracPart := mantissa, []byte(nil)
+	if i := bytes.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+		if len(intPart) == 0 && len(fracPart) == 0 {
+			return false
+		}
+		if len(fracPart) > 0 && !isDigits(fracPart) {
+			return false
+		}
+		return len(intPart) == 0 || isDigits(intPart)
+	}
+	return isDigits(intPart)
+}
+
+func isDigits(s []byte) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Jump Trading
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build small
+
+package listener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLineValid(t *testing.T) {
+	valid := []string{
+		"foo x=1",
+		"foo x=1\n",
+		"foo x=1\r\n",
+		"foo x=1 ",
+		"foo x=1 1500000000000000000",
+		"foo x=-1 -1500000000",
+		"foo,host=a x=1",
+		"foo,host=a,region=b x=1,y=2 123",
+		`foo\ bar,host\,name=a\ b\=c x\ y=1`,
+		"foo x=1.5,y=-.5,z=1.,a=1e10,b=1.5E-3,c=+2",
+		"foo x=1i,y=-9223372036854775808i",
+		"foo x=1u",
+		"foo a=t,b=T,c=true,d=True,e=TRUE,f=f,g=F,h=false,i=False,j=FALSE",
+		`foo s="hello world"`,
+		`foo s="with, comma=and \"quotes\"",x=1 123`,
+		`foo s=""`,
+	}
+	for _, line := range valid {
+		assert.NoError(t, validateLine([]byte(line)), "validateLine(%q)", line)
+	}
+}
+
+func TestValidateLineInvalid(t *testing.T) {
+	check := func(line string, expected error) {
+		assert.Equal(t, expected, validateLine([]byte(line)), "validateLine(%q)", line)
+	}
+
+	check("", errMissingMeasurement)
+	check(",host=a x=1", errMissingMeasurement)
+	check(" x=1", errMissingMeasurement)
+	check("foo", errMissingFields)
+	check("foo ", errMissingFields)
+	check("foo,host=a", errMissingFields)
+	check(`foo\`, errInvalidEscape)
+	check(`foo x\`, errInvalidEscape)
+	check("foo,=a x=1", errMissingTagKey)
+	check("foo,host x=1", errMissingTagValue)
+	check("foo,host= x=1", errMissingTagValue)
+	check("foo,host=a, x=1", errMissingTagKey)
+	check("foo =1", errMissingFieldKey)
+	check("foo x=1,=2", errMissingFieldKey)
+	check("foo x", errMissingFieldValue)
+	check("foo x=", errMissingFieldValue)
+	check("foo x=1,y", errMissingFieldValue)
+	check("foo x=,y=1", errMissingFieldValue)
+	check("foo x=abc", errInvalidFieldValue)
+	check("foo x=1.2.3", errInvalidFieldValue)
+	check("foo x=.", errInvalidFieldValue)
+	check("foo x=1e", errInvalidFieldValue)
+	check("foo x=1.5i", errInvalidFieldValue)
+	check("foo x=i", errInvalidFieldValue)
+	check("foo x=9223372036854775808i", errInvalidFieldValue)
+	check("foo x=-1u", errInvalidFieldValue)
+	check("foo x=u", errInvalidFieldValue)
+	check("foo x=yes", errInvalidFieldValue)
+	check(`foo s="abc"d`, errInvalidFieldValue)
+	check(`foo s="abc`, errUnterminatedString)
+	check(`foo s="abc\"`, errUnterminatedString)
+	check("foo x=1 abc", errInvalidTimestamp)
+	check("foo x=1 1 2", errInvalidTimestamp)
+	check("foo x=1  123", errInvalidTimestamp)
+}
+
+func TestFilterLines(t *testing.T) {
+	var rejected []string
+	reject := func(line []byte, err error) {
+		rejected = append(rejected, string(line)+":"+err.Error())
+	}
+
+	lines := []byte("foo x=1\nbad\n\n# comment\nbar y=2\nfinal z=3")
+	out := filterLines(lines, validateLine, reject)
+	assert.Equal(t, "foo x=1\nbar y=2\nfinal z=3", string(out))
+	assert.Equal(t, []string{"bad\n:missing fields"}, rejected)
+
+	rejected = nil
+	out = filterLines([]byte("foo x=1\nbad"), validateLine, reject)
+	assert.Equal(t, "foo x=1\n", string(out))
+	assert.Equal(t, []string{"bad:missing fields"}, rejected)
+}
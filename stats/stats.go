@@ -51,12 +51,18 @@ func (s *Stats) Get(name string) int {
 // Inc increments a stats counter, returning the new value. It panics
 // if the counter is not valid.
 func (s *Stats) Inc(name string) int {
+	return s.Add(name, 1)
+}
+
+// Add increases a stats counter by n, returning the new value. It
+// panics if the counter is not valid.
+func (s *Stats) Add(name string, n int) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, ok := s.counts[name]; !ok {
 		panic(fmt.Sprintf("unknown stat: %q", name))
 	}
-	s.counts[name]++
+	s.counts[name] += n
 	return s.counts[name]
 }
 
@@ -41,11 +41,21 @@ func TestBasics(t *testing.T) {
 	assert.Equal(t, 0, s.Get("bar"))
 }
 
+func TestAdd(t *testing.T) {
+	s := stats.New("foo")
+
+	assert.Equal(t, 5, s.Add("foo", 5))
+	assert.Equal(t, 6, s.Inc("foo"))
+	assert.Equal(t, 16, s.Add("foo", 10))
+	assert.Equal(t, 16, s.Get("foo"))
+}
+
 func TestInvalid(t *testing.T) {
 	s := stats.New("foo")
 
 	assert.Panics(t, func() { s.Get("bar") })
 	assert.Panics(t, func() { s.Inc("bar") })
+	assert.Panics(t, func() { s.Add("bar", 2) })
 	assert.Equal(t, 0, s.Get("foo"))
 }
 